@@ -0,0 +1,419 @@
+// Package aperturetest provides utilities for testing code using the Aperture SDK without a running Aperture Agent.
+package aperturetest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// bufSize is the size of the in-memory connection buffer.
+const bufSize = 1024 * 1024
+
+// Policy name and component ID of the limiter in the Check responses of the fake agent.
+const (
+	PolicyName  = "aperturetest"
+	ComponentID = "aperturetest-limiter"
+)
+
+// Decision scripts how the fake agent answers the Check calls for a control point. The zero value accepts the flows.
+type Decision struct {
+	// Reject rejects the flows.
+	Reject bool
+	// RejectReason is the reject reason of rejected flows. Defaults to REJECT_REASON_RATE_LIMITED.
+	RejectReason checkv1.CheckResponse_RejectReason
+	// StatusCode is the denied response status code of rejected flows. Defaults to 429 Too Many Requests.
+	StatusCode int
+	// WaitTime is the retry-after duration advised for rejected flows.
+	WaitTime time.Duration
+	// Delay delays the response, unless the Check call is cancelled first.
+	Delay time.Duration
+	// Err fails the Check call with this error. Use status.Error to fail it with a particular gRPC code.
+	Err error
+}
+
+// cacheEntry is a value stored in the cache of the fake agent.
+type cacheEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Agent is an in-memory fake of Aperture Agent serving the flow control and OTLP trace services over bufconn.
+// It answers the Check calls as scripted per control point, serves the result and global caches, and records every request.
+type Agent struct {
+	checkv1.UnimplementedFlowControlServiceServer
+	checkhttpv1.UnimplementedFlowControlServiceHTTPServer
+	coltracepb.UnimplementedTraceServiceServer
+
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	mu                  sync.Mutex
+	decisions           map[string]Decision
+	defaultDecision     Decision
+	requestID           int
+	resultCache         map[string]cacheEntry
+	globalCache         map[string]cacheEntry
+	checkRequests       []*checkv1.CheckRequest
+	checkHTTPRequests   []*checkhttpv1.CheckHTTPRequest
+	cacheUpsertRequests []*checkv1.CacheUpsertRequest
+	cacheDeleteRequests []*checkv1.CacheDeleteRequest
+	flowEndRequests     []*checkv1.FlowEndRequest
+	traceExportRequests []*coltracepb.ExportTraceServiceRequest
+}
+
+// Compile-time checks of the implemented services.
+var (
+	_ checkv1.FlowControlServiceServer         = (*Agent)(nil)
+	_ checkhttpv1.FlowControlServiceHTTPServer = (*Agent)(nil)
+	_ coltracepb.TraceServiceServer            = (*Agent)(nil)
+)
+
+// NewAgent starts a fake agent accepting all flows. It has to be closed once no longer used.
+func NewAgent() *Agent {
+	a := &Agent{
+		listener:    bufconn.Listen(bufSize),
+		server:      grpc.NewServer(),
+		decisions:   make(map[string]Decision),
+		resultCache: make(map[string]cacheEntry),
+		globalCache: make(map[string]cacheEntry),
+	}
+	checkv1.RegisterFlowControlServiceServer(a.server, a)
+	checkhttpv1.RegisterFlowControlServiceHTTPServer(a.server, a)
+	coltracepb.RegisterTraceServiceServer(a.server, a)
+	go func() {
+		_ = a.server.Serve(a.listener)
+	}()
+	return a
+}
+
+// Close stops the fake agent.
+func (a *Agent) Close() {
+	a.server.Stop()
+}
+
+// DialOptions returns the grpc dial options connecting to the fake agent.
+func (a *Agent) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return a.listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+}
+
+// SetDecision scripts the answers to the Check calls for a control point.
+func (a *Agent) SetDecision(controlPoint string, decision Decision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decisions[controlPoint] = decision
+}
+
+// SetDefaultDecision scripts the answers to the Check calls for the control points without a Decision.
+func (a *Agent) SetDefaultDecision(decision Decision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaultDecision = decision
+}
+
+// CheckRequests returns the recorded Check requests.
+func (a *Agent) CheckRequests() []*checkv1.CheckRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*checkv1.CheckRequest(nil), a.checkRequests...)
+}
+
+// CheckHTTPRequests returns the recorded CheckHTTP requests.
+func (a *Agent) CheckHTTPRequests() []*checkhttpv1.CheckHTTPRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*checkhttpv1.CheckHTTPRequest(nil), a.checkHTTPRequests...)
+}
+
+// CacheUpsertRequests returns the recorded CacheUpsert requests.
+func (a *Agent) CacheUpsertRequests() []*checkv1.CacheUpsertRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*checkv1.CacheUpsertRequest(nil), a.cacheUpsertRequests...)
+}
+
+// CacheDeleteRequests returns the recorded CacheDelete requests.
+func (a *Agent) CacheDeleteRequests() []*checkv1.CacheDeleteRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*checkv1.CacheDeleteRequest(nil), a.cacheDeleteRequests...)
+}
+
+// FlowEndRequests returns the recorded FlowEnd requests.
+func (a *Agent) FlowEndRequests() []*checkv1.FlowEndRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*checkv1.FlowEndRequest(nil), a.flowEndRequests...)
+}
+
+// TraceExportRequests returns the recorded OTLP trace export requests, carrying the exported flow spans.
+func (a *Agent) TraceExportRequests() []*coltracepb.ExportTraceServiceRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*coltracepb.ExportTraceServiceRequest(nil), a.traceExportRequests...)
+}
+
+// Reset forgets the recorded requests and cache entries. The scripted decisions are kept.
+func (a *Agent) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resultCache = make(map[string]cacheEntry)
+	a.globalCache = make(map[string]cacheEntry)
+	a.checkRequests = nil
+	a.checkHTTPRequests = nil
+	a.cacheUpsertRequests = nil
+	a.cacheDeleteRequests = nil
+	a.flowEndRequests = nil
+	a.traceExportRequests = nil
+}
+
+// Check answers a Check call as scripted for its control point.
+func (a *Agent) Check(ctx context.Context, req *checkv1.CheckRequest) (*checkv1.CheckResponse, error) {
+	a.mu.Lock()
+	a.checkRequests = append(a.checkRequests, proto.Clone(req).(*checkv1.CheckRequest))
+	a.mu.Unlock()
+
+	decision, err := a.decide(ctx, req.GetControlPoint())
+	if err != nil {
+		return nil, err
+	}
+	res := a.checkResponse(req.GetControlPoint(), decision)
+
+	if lookup := req.GetCacheLookupRequest(); lookup != nil && (lookup.GetResultCacheKey() != "" || len(lookup.GetGlobalCacheKeys()) > 0) {
+		res.CacheLookupResponse = a.cacheLookup(req.GetControlPoint(), lookup)
+	}
+	return res, nil
+}
+
+// CheckHTTP answers a CheckHTTP call as scripted for its control point.
+func (a *Agent) CheckHTTP(ctx context.Context, req *checkhttpv1.CheckHTTPRequest) (*checkhttpv1.CheckHTTPResponse, error) {
+	a.mu.Lock()
+	a.checkHTTPRequests = append(a.checkHTTPRequests, proto.Clone(req).(*checkhttpv1.CheckHTTPRequest))
+	a.mu.Unlock()
+
+	decision, err := a.decide(ctx, req.GetControlPoint())
+	if err != nil {
+		return nil, err
+	}
+	checkResponse := a.checkResponse(req.GetControlPoint(), decision)
+
+	if checkResponse.GetDecisionType() == checkv1.CheckResponse_DECISION_TYPE_ACCEPTED {
+		return &checkhttpv1.CheckHTTPResponse{
+			Status:        &status.Status{Code: int32(code.Code_OK)},
+			HttpResponse:  &checkhttpv1.CheckHTTPResponse_OkResponse{OkResponse: &checkhttpv1.OkHttpResponse{}},
+			CheckResponse: checkResponse,
+		}, nil
+	}
+
+	headers := map[string]string{}
+	if decision.WaitTime > 0 {
+		headers["Retry-After"] = strconv.Itoa(int((decision.WaitTime + time.Second - 1) / time.Second))
+	}
+	return &checkhttpv1.CheckHTTPResponse{
+		Status: &status.Status{Code: int32(code.Code_UNAVAILABLE)},
+		HttpResponse: &checkhttpv1.CheckHTTPResponse_DeniedResponse{DeniedResponse: &checkhttpv1.DeniedHttpResponse{
+			Status:  int32(checkResponse.GetDeniedResponseStatusCode()),
+			Headers: headers,
+			Body:    fmt.Sprintf("rejected by %s", PolicyName),
+		}},
+		CheckResponse: checkResponse,
+	}, nil
+}
+
+// CacheLookup looks up the result and global cache entries.
+func (a *Agent) CacheLookup(ctx context.Context, req *checkv1.CacheLookupRequest) (*checkv1.CacheLookupResponse, error) {
+	return a.cacheLookup(req.GetControlPoint(), req), nil
+}
+
+// CacheUpsert stores the result and global cache entries.
+func (a *Agent) CacheUpsert(ctx context.Context, req *checkv1.CacheUpsertRequest) (*checkv1.CacheUpsertResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cacheUpsertRequests = append(a.cacheUpsertRequests, proto.Clone(req).(*checkv1.CacheUpsertRequest))
+
+	res := &checkv1.CacheUpsertResponse{
+		GlobalCacheResponses: make(map[string]*checkv1.KeyUpsertResponse, len(req.GetGlobalCacheEntries())),
+	}
+	if entry := req.GetResultCacheEntry(); entry != nil {
+		a.resultCache[resultCacheKey(req.GetControlPoint(), entry.GetKey())] = newCacheEntry(entry)
+		res.ResultCacheResponse = &checkv1.KeyUpsertResponse{OperationStatus: checkv1.CacheOperationStatus_SUCCESS}
+	}
+	for key, entry := range req.GetGlobalCacheEntries() {
+		a.globalCache[key] = newCacheEntry(entry)
+		res.GlobalCacheResponses[key] = &checkv1.KeyUpsertResponse{OperationStatus: checkv1.CacheOperationStatus_SUCCESS}
+	}
+	return res, nil
+}
+
+// CacheDelete deletes the result and global cache entries.
+func (a *Agent) CacheDelete(ctx context.Context, req *checkv1.CacheDeleteRequest) (*checkv1.CacheDeleteResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cacheDeleteRequests = append(a.cacheDeleteRequests, proto.Clone(req).(*checkv1.CacheDeleteRequest))
+
+	res := &checkv1.CacheDeleteResponse{
+		GlobalCacheResponses: make(map[string]*checkv1.KeyDeleteResponse, len(req.GetGlobalCacheKeys())),
+	}
+	if req.GetResultCacheKey() != "" {
+		delete(a.resultCache, resultCacheKey(req.GetControlPoint(), req.GetResultCacheKey()))
+		res.ResultCacheResponse = &checkv1.KeyDeleteResponse{OperationStatus: checkv1.CacheOperationStatus_SUCCESS}
+	}
+	for _, key := range req.GetGlobalCacheKeys() {
+		delete(a.globalCache, key)
+		res.GlobalCacheResponses[key] = &checkv1.KeyDeleteResponse{OperationStatus: checkv1.CacheOperationStatus_SUCCESS}
+	}
+	return res, nil
+}
+
+// FlowEnd records the end of a flow.
+func (a *Agent) FlowEnd(ctx context.Context, req *checkv1.FlowEndRequest) (*checkv1.FlowEndResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flowEndRequests = append(a.flowEndRequests, proto.Clone(req).(*checkv1.FlowEndRequest))
+	return &checkv1.FlowEndResponse{}, nil
+}
+
+// Export records the exported spans.
+func (a *Agent) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.traceExportRequests = append(a.traceExportRequests, proto.Clone(req).(*coltracepb.ExportTraceServiceRequest))
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// decide returns the scripted decision for a control point, once its delay has passed.
+func (a *Agent) decide(ctx context.Context, controlPoint string) (Decision, error) {
+	a.mu.Lock()
+	decision, ok := a.decisions[controlPoint]
+	if !ok {
+		decision = a.defaultDecision
+	}
+	a.mu.Unlock()
+
+	if decision.Delay > 0 {
+		timer := time.NewTimer(decision.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return decision, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return decision, decision.Err
+}
+
+// checkResponse builds the Check response of a decision.
+// Accepted flows hold a concurrency limiter slot, so that their ends are reported with FlowEnd.
+func (a *Agent) checkResponse(controlPoint string, decision Decision) *checkv1.CheckResponse {
+	a.mu.Lock()
+	a.requestID++
+	requestID := strconv.Itoa(a.requestID)
+	a.mu.Unlock()
+
+	res := &checkv1.CheckResponse{
+		ControlPoint: controlPoint,
+		DecisionType: checkv1.CheckResponse_DECISION_TYPE_ACCEPTED,
+		LimiterDecisions: []*checkv1.LimiterDecision{{
+			PolicyName:  PolicyName,
+			ComponentId: ComponentID,
+			Details: &checkv1.LimiterDecision_ConcurrencyLimiterInfo_{
+				ConcurrencyLimiterInfo: &checkv1.LimiterDecision_ConcurrencyLimiterInfo{
+					RequestId: requestID,
+				},
+			},
+		}},
+	}
+	if !decision.Reject {
+		return res
+	}
+
+	statusCode := decision.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusTooManyRequests
+	}
+	rejectReason := decision.RejectReason
+	if rejectReason == checkv1.CheckResponse_REJECT_REASON_NONE {
+		rejectReason = checkv1.CheckResponse_REJECT_REASON_RATE_LIMITED
+	}
+	res.DecisionType = checkv1.CheckResponse_DECISION_TYPE_REJECTED
+	res.RejectReason = rejectReason
+	res.DeniedResponseStatusCode = checkv1.StatusCode(statusCode)
+	res.LimiterDecisions = []*checkv1.LimiterDecision{{
+		PolicyName:  PolicyName,
+		ComponentId: ComponentID,
+		Dropped:     true,
+	}}
+	if decision.WaitTime > 0 {
+		res.WaitTime = durationpb.New(decision.WaitTime)
+		res.LimiterDecisions[0].WaitTime = res.WaitTime
+	}
+	return res
+}
+
+// cacheLookup looks up the result and global cache entries requested at a control point.
+func (a *Agent) cacheLookup(controlPoint string, req *checkv1.CacheLookupRequest) *checkv1.CacheLookupResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := &checkv1.CacheLookupResponse{
+		GlobalCacheResponses: make(map[string]*checkv1.KeyLookupResponse, len(req.GetGlobalCacheKeys())),
+	}
+	if req.GetResultCacheKey() != "" {
+		res.ResultCacheResponse = lookupCacheEntry(a.resultCache, resultCacheKey(controlPoint, req.GetResultCacheKey()))
+	}
+	for _, key := range req.GetGlobalCacheKeys() {
+		res.GlobalCacheResponses[key] = lookupCacheEntry(a.globalCache, key)
+	}
+	return res
+}
+
+// resultCacheKey scopes a result cache key to its control point.
+func resultCacheKey(controlPoint, key string) string {
+	return controlPoint + "/" + key
+}
+
+// newCacheEntry converts an upserted cache entry, which expires after its TTL if set.
+func newCacheEntry(entry *checkv1.CacheEntry) cacheEntry {
+	e := cacheEntry{value: entry.GetValue()}
+	if ttl := entry.GetTtl().AsDuration(); ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+	return e
+}
+
+// lookupCacheEntry looks up a cache entry, which is a miss if it does not exist or has expired.
+func lookupCacheEntry(cache map[string]cacheEntry, key string) *checkv1.KeyLookupResponse {
+	entry, ok := cache[key]
+	if !ok || (!entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt)) {
+		return &checkv1.KeyLookupResponse{
+			LookupStatus:    checkv1.CacheLookupStatus_MISS,
+			OperationStatus: checkv1.CacheOperationStatus_SUCCESS,
+		}
+	}
+	return &checkv1.KeyLookupResponse{
+		Value:           entry.value,
+		LookupStatus:    checkv1.CacheLookupStatus_HIT,
+		OperationStatus: checkv1.CacheOperationStatus_SUCCESS,
+	}
+}
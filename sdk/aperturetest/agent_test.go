@@ -0,0 +1,223 @@
+package aperturetest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+func TestAgentAccepts(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+
+	flow := client.StartFlow(context.Background(), "accepted", aperture.FlowParams{
+		Labels: map[string]string{"user": "alice"},
+	})
+	if !flow.ShouldRun() {
+		t.Fatalf("ShouldRun() = false, want true")
+	}
+	if res := flow.End(); res.Error != nil {
+		t.Fatalf("End() error = %v", res.Error)
+	}
+
+	checkRequests := agent.CheckRequests()
+	if len(checkRequests) != 1 {
+		t.Fatalf("Check requests = %d, want 1", len(checkRequests))
+	}
+	if got := checkRequests[0].GetLabels()["user"]; got != "alice" {
+		t.Errorf("label user = %q, want %q", got, "alice")
+	}
+	if got := len(agent.FlowEndRequests()); got != 1 {
+		t.Errorf("FlowEnd requests = %d, want 1", got)
+	}
+}
+
+func TestAgentRejects(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDecision("rejected", aperturetest.Decision{
+		Reject:     true,
+		StatusCode: http.StatusServiceUnavailable,
+		WaitTime:   2 * time.Second,
+	})
+
+	flow := client.StartFlow(context.Background(), "rejected", aperture.FlowParams{})
+	defer flow.End()
+
+	rejection := flow.RejectionError()
+	if rejection == nil {
+		t.Fatalf("RejectionError() = nil, want rejection")
+	}
+	if rejection.HTTPStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("HTTPStatusCode = %d, want %d", rejection.HTTPStatusCode, http.StatusServiceUnavailable)
+	}
+	if rejection.RetryAfter != 2*time.Second {
+		t.Errorf("RetryAfter = %s, want 2s", rejection.RetryAfter)
+	}
+	if len(rejection.DroppedBy) != 1 || rejection.DroppedBy[0].PolicyName != aperturetest.PolicyName {
+		t.Errorf("DroppedBy = %v, want the %s policy", rejection.DroppedBy, aperturetest.PolicyName)
+	}
+}
+
+func TestAgentFails(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDefaultDecision(aperturetest.Decision{Err: status.Error(codes.Unavailable, "agent down")})
+
+	flow := client.StartFlow(context.Background(), "failing", aperture.FlowParams{FailureMode: aperture.FailClosed})
+	defer flow.End()
+
+	if flow.ShouldRun() {
+		t.Errorf("ShouldRun() = true, want false")
+	}
+	if got := status.Code(flow.Error()); got != codes.Unavailable {
+		t.Errorf("Error() code = %s, want %s", got, codes.Unavailable)
+	}
+	if got := flow.DecisionSource(); got != aperture.DecisionSourceFailureMode {
+		t.Errorf("DecisionSource() = %s, want %s", got, aperture.DecisionSourceFailureMode)
+	}
+}
+
+func TestAgentDelays(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDecision("slow", aperturetest.Decision{Delay: time.Second})
+
+	flow := client.StartFlow(context.Background(), "slow", aperture.FlowParams{Timeout: 10 * time.Millisecond})
+	defer flow.End()
+
+	if !errors.Is(flow.Error(), aperture.ErrCheckTimeout) {
+		t.Errorf("Error() = %v, want %v", flow.Error(), aperture.ErrCheckTimeout)
+	}
+}
+
+func TestAgentResultCache(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	params := aperture.RunParams{
+		FlowParams:     aperture.FlowParams{ResultCacheKey: "answer"},
+		ResultCacheTTL: time.Minute,
+	}
+
+	calls := 0
+	compute := func(context.Context) (int, error) {
+		calls++
+		return 42, nil
+	}
+	for i := 0; i < 2; i++ {
+		got, err := aperture.Run(context.Background(), client, "cached", params, compute)
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if got != 42 {
+			t.Errorf("Run() = %d, want 42", got)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("workload calls = %d, want 1", calls)
+	}
+	if got := len(agent.CacheUpsertRequests()); got != 1 {
+		t.Errorf("CacheUpsert requests = %d, want 1", got)
+	}
+}
+
+func TestAgentCheckHTTP(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDecision("http", aperturetest.Decision{Reject: true, WaitTime: time.Second})
+
+	flow := client.StartHTTPFlow(context.Background(), &checkhttpv1.CheckHTTPRequest{ControlPoint: "http"}, aperture.MiddlewareParams{})
+	defer flow.End()
+
+	if flow.ShouldRun() {
+		t.Fatalf("ShouldRun() = true, want false")
+	}
+	deniedResponse := flow.CheckResponse().GetDeniedResponse()
+	if deniedResponse.GetStatus() != http.StatusTooManyRequests {
+		t.Errorf("denied response status = %d, want %d", deniedResponse.GetStatus(), http.StatusTooManyRequests)
+	}
+	if got := deniedResponse.GetHeaders()["Retry-After"]; got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+	if got := len(agent.CheckHTTPRequests()); got != 1 {
+		t.Errorf("CheckHTTP requests = %d, want 1", got)
+	}
+}
+
+func TestAgentLocalCache(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		LocalCache: aperture.LocalCacheOptions{MaxEntries: 10},
+	})
+
+	flow := client.StartFlow(context.Background(), "writer", aperture.FlowParams{})
+	if res := flow.SetGlobalCache(context.Background(), "hot", aperture.CacheEntry{Value: []byte("value"), TTL: time.Minute}); res.Error() != nil {
+		t.Fatalf("SetGlobalCache() error = %v", res.Error())
+	}
+	flow.End()
+
+	flow = client.StartFlow(context.Background(), "reader", aperture.FlowParams{})
+	defer flow.End()
+	lookup := flow.GlobalCache("hot")
+	if lookup.LookupStatus() != aperture.LookupStatusHit || string(lookup.Value()) != "value" {
+		t.Errorf("GlobalCache() = %q, %s, want %q, %s", lookup.Value(), lookup.LookupStatus(), "value", aperture.LookupStatusHit)
+	}
+	if got := agent.CheckRequests()[1].GetCacheLookupRequest().GetGlobalCacheKeys(); len(got) != 0 {
+		t.Errorf("global cache keys looked up in Aperture Agent = %v, want none", got)
+	}
+	if got := client.LocalCacheStats(); got.Hits != 1 || got.Entries != 1 {
+		t.Errorf("LocalCacheStats() = %+v, want 1 hit and 1 entry", got)
+	}
+}
+
+func TestAgentGlobalCache(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	globalCache := client.GlobalCache()
+	ctx := context.Background()
+
+	setResponses := globalCache.Set(ctx, map[string]aperture.CacheEntry{
+		"first":  {Value: []byte("1"), TTL: time.Minute},
+		"second": {Value: []byte("2"), TTL: time.Minute},
+	})
+	for key, res := range setResponses {
+		if res.Error() != nil {
+			t.Errorf("Set() error for %q = %v", key, res.Error())
+		}
+	}
+	if got := len(agent.CacheUpsertRequests()); got != 1 {
+		t.Errorf("CacheUpsert requests = %d, want 1", got)
+	}
+
+	globalCache.Delete(ctx, []string{"second"})
+	lookups := globalCache.Get(ctx, []string{"first", "second"})
+	if got := lookups["first"]; got.LookupStatus() != aperture.LookupStatusHit || string(got.Value()) != "1" {
+		t.Errorf("Get() first = %q, %s, want %q, %s", got.Value(), got.LookupStatus(), "1", aperture.LookupStatusHit)
+	}
+	if got := lookups["second"].LookupStatus(); got != aperture.LookupStatusMiss {
+		t.Errorf("Get() second status = %s, want %s", got, aperture.LookupStatusMiss)
+	}
+	if got := len(agent.CheckRequests()); got != 0 {
+		t.Errorf("Check requests = %d, want 0", got)
+	}
+}
+
+func TestAgentTypedCache(t *testing.T) {
+	client, _ := aperturetest.NewTestClient(t, aperture.Options{})
+	typedCache := aperture.NewTypedCache[[]string](aperture.TypedCacheOptions{CompressionThreshold: 16})
+	ctx := context.Background()
+
+	want := []string{"alice", "bob", "carol"}
+	if err := typedCache.Set(ctx, client.GlobalCache(), "users", want, time.Minute); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	got, hit, err := typedCache.Get(ctx, client.GlobalCache(), "users")
+	if err != nil || !hit {
+		t.Fatalf("Get() = %t, %v, want a hit", hit, err)
+	}
+	if len(got) != len(want) || got[2] != want[2] {
+		t.Errorf("Get() = %v, want %v", got, want)
+	}
+}
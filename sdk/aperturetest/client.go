@@ -0,0 +1,48 @@
+package aperturetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+)
+
+// shutdownTimeout bounds the wait for the in-flight flows when the client of NewTestClient is shut down.
+const shutdownTimeout = time.Second
+
+// bufnetAddress is the address the clients of the fake agent dial, resolved by the bufconn dialer.
+const bufnetAddress = "passthrough:///bufnet"
+
+// NewClient returns a Client connected to the fake agent.
+// Options.Address and Options.DialOptions are overridden. Unless Options.SpanExporter is set, the flow spans are discarded.
+func (a *Agent) NewClient(ctx context.Context, opts aperture.Options) (aperture.Client, error) {
+	opts.Address = bufnetAddress
+	opts.DialOptions = a.DialOptions()
+	if opts.SpanExporter == nil {
+		opts.SpanExporter = tracetest.NewNoopExporter()
+	}
+	return aperture.NewClient(ctx, opts)
+}
+
+// NewTestClient starts a fake agent and returns a Client connected to it, configured with opts.
+// Both are shut down once the test completes, ending the flows left in flight.
+func NewTestClient(t testing.TB, opts aperture.Options) (aperture.Client, *Agent) {
+	t.Helper()
+
+	agent := NewAgent()
+	t.Cleanup(agent.Close)
+
+	client, err := agent.NewClient(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("aperturetest: failed to create client: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = client.Shutdown(ctx)
+	})
+	return client, agent
+}
@@ -0,0 +1,179 @@
+package aperturetest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// Client is a test double of aperture.Client which starts Flow and HTTPFlow test doubles and records them.
+// Unlike the clients of Agent, it makes no calls at all.
+type Client struct {
+	log         *slog.Logger
+	globalCache *GlobalCache
+
+	mu                  sync.Mutex
+	flowOptions         map[string]FlowOptions
+	defaultFlowOptions  FlowOptions
+	circuitBreakerState aperture.CircuitBreakerState
+	flowRequests        []aperture.FlowRequest
+	flows               []*Flow
+	httpFlows           []*HTTPFlow
+	shutdowns           int
+}
+
+// Client implements the aperture.Client interface.
+var _ aperture.Client = (*Client)(nil)
+
+// NewClient returns a Client test double whose flows are accepted until configured otherwise.
+func NewClient() *Client {
+	return &Client{
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		globalCache: NewGlobalCache(),
+		flowOptions: make(map[string]FlowOptions),
+	}
+}
+
+// SetFlowOptions sets the options of the flows started at controlPoint. FlowOptions.ControlPoint is overridden.
+func (c *Client) SetFlowOptions(controlPoint string, opts FlowOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flowOptions[controlPoint] = opts
+}
+
+// SetDefaultFlowOptions sets the options of the flows started at control points without options of their own.
+func (c *Client) SetDefaultFlowOptions(opts FlowOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.defaultFlowOptions = opts
+}
+
+// SetCircuitBreakerState sets the state returned by CircuitBreakerState.
+func (c *Client) SetCircuitBreakerState(state aperture.CircuitBreakerState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.circuitBreakerState = state
+}
+
+// StartFlow records the request and returns a Flow test double with the options of controlPoint.
+func (c *Client) StartFlow(ctx context.Context, controlPoint string, flowParams aperture.FlowParams) aperture.Flow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flow := NewFlow(c.flowOptionsLocked(controlPoint))
+	c.flowRequests = append(c.flowRequests, aperture.FlowRequest{ControlPoint: controlPoint, FlowParams: flowParams})
+	c.flows = append(c.flows, flow)
+	return flow
+}
+
+// StartFlows starts the requested flows one by one, ignoring parallelism.
+func (c *Client) StartFlows(ctx context.Context, requests []aperture.FlowRequest, parallelism int) aperture.Flows {
+	flows := make(aperture.Flows, len(requests))
+	for i, request := range requests {
+		flows[i] = c.StartFlow(ctx, request.ControlPoint, request.FlowParams)
+	}
+	return flows
+}
+
+// StartHTTPFlow records the flow and returns an HTTPFlow test double with the options of the control point of the request.
+func (c *Client) StartHTTPFlow(ctx context.Context, request *checkhttpv1.CheckHTTPRequest, middlewareParams aperture.MiddlewareParams) aperture.HTTPFlow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flow := NewHTTPFlow(c.flowOptionsLocked(request.GetControlPoint()))
+	c.httpFlows = append(c.httpFlows, flow)
+	return flow
+}
+
+// flowOptionsLocked returns the options of the flows started at controlPoint. c.mu must be held.
+func (c *Client) flowOptionsLocked(controlPoint string) FlowOptions {
+	opts, ok := c.flowOptions[controlPoint]
+	if !ok {
+		opts = c.defaultFlowOptions
+	}
+	opts.ControlPoint = controlPoint
+	return opts
+}
+
+// Shutdown records the call.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdowns++
+	return nil
+}
+
+// GetLogger returns a logger discarding its records.
+func (c *Client) GetLogger() *slog.Logger {
+	return c.log
+}
+
+// GetGRPClientConn returns nil, the test double has no connection.
+func (c *Client) GetGRPClientConn() *grpc.ClientConn {
+	return nil
+}
+
+// CircuitBreakerState returns the state set with SetCircuitBreakerState, CircuitBreakerClosed by default.
+func (c *Client) CircuitBreakerState() aperture.CircuitBreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.circuitBreakerState
+}
+
+// LocalCacheStats returns zero stats, the test double has no local cache.
+func (c *Client) LocalCacheStats() aperture.LocalCacheStats {
+	return aperture.LocalCacheStats{}
+}
+
+// GlobalCache returns the in-memory GlobalCache test double of the client.
+func (c *Client) GlobalCache() aperture.GlobalCache {
+	return c.globalCache
+}
+
+// FlowRequests returns the control points and parameters of the flows started with StartFlow and StartFlows, in order.
+func (c *Client) FlowRequests() []aperture.FlowRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]aperture.FlowRequest(nil), c.flowRequests...)
+}
+
+// Flows returns the flows started with StartFlow and StartFlows, in order.
+func (c *Client) Flows() []*Flow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Flow(nil), c.flows...)
+}
+
+// HTTPFlows returns the flows started with StartHTTPFlow, in order.
+func (c *Client) HTTPFlows() []*HTTPFlow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*HTTPFlow(nil), c.httpFlows...)
+}
+
+// ShutdownCalls returns the number of Shutdown calls.
+func (c *Client) ShutdownCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdowns
+}
+
+// AssertAllEnded fails the test unless every flow started by the client was ended exactly once.
+func (c *Client) AssertAllEnded(t testing.TB) {
+	t.Helper()
+	for _, flow := range c.Flows() {
+		if ends := len(flow.EndStatuses()); ends != 1 {
+			t.Errorf("flow at control point %q was ended %d times, want once", flow.opts.ControlPoint, ends)
+		}
+	}
+	for _, flow := range c.HTTPFlows() {
+		if ends := len(flow.EndStatuses()); ends != 1 {
+			t.Errorf("HTTP flow at control point %q was ended %d times, want once", flow.opts.ControlPoint, ends)
+		}
+	}
+}
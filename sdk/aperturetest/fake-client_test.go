@@ -0,0 +1,150 @@
+package aperturetest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+func TestClientRunEndsFlowWithError(t *testing.T) {
+	client := aperturetest.NewClient()
+
+	_, err := aperture.Run(context.Background(), client, "failing", aperture.RunParams{}, func(context.Context) (int, error) {
+		return 0, errors.New("boom")
+	})
+	if err == nil {
+		t.Fatalf("Run() error = nil, want error")
+	}
+
+	flows := client.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("flows = %d, want 1", len(flows))
+	}
+	flows[0].AssertEnded(t, aperture.Error)
+	client.AssertAllEnded(t)
+}
+
+func TestClientRejectedFlow(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetFlowOptions("rejected", aperturetest.FlowOptions{
+		Reject:         true,
+		DecisionSource: aperture.DecisionSourceAgent,
+		RetryAfter:     time.Second,
+	})
+
+	_, err := aperture.Run(context.Background(), client, "rejected", aperture.RunParams{}, func(context.Context) (int, error) {
+		t.Fatalf("workload ran for a rejected flow")
+		return 0, nil
+	})
+
+	var rejection *aperture.RejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("Run() error = %v, want a *RejectionError", err)
+	}
+	if rejection.HTTPStatusCode != http.StatusTooManyRequests {
+		t.Errorf("HTTPStatusCode = %d, want %d", rejection.HTTPStatusCode, http.StatusTooManyRequests)
+	}
+	if rejection.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %s, want 1s", rejection.RetryAfter)
+	}
+	flow := client.Flows()[0]
+	flow.AssertEnded(t, aperture.OK)
+	if statuses := flow.Statuses(); len(statuses) != 0 {
+		t.Errorf("statuses set on a rejected flow = %v, want none", statuses)
+	}
+}
+
+func TestFlowDecisionFromCheckResponse(t *testing.T) {
+	rejected := &checkv1.CheckResponse{
+		DecisionType:             checkv1.CheckResponse_DECISION_TYPE_REJECTED,
+		RejectReason:             checkv1.CheckResponse_REJECT_REASON_RATE_LIMITED,
+		WaitTime:                 durationpb.New(time.Second),
+		DeniedResponseStatusCode: checkv1.StatusCode_ServiceUnavailable,
+	}
+	for _, tc := range []struct {
+		name string
+		flow interface {
+			RejectionError() *aperture.RejectionError
+		}
+		wantStatusCode int
+	}{
+		{
+			name:           "flow",
+			flow:           aperturetest.NewFlow(aperturetest.FlowOptions{CheckResponse: rejected}),
+			wantStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "HTTP flow",
+			flow: aperturetest.NewHTTPFlow(aperturetest.FlowOptions{CheckHTTPResponse: &checkhttpv1.CheckHTTPResponse{
+				Status:        &status.Status{Code: int32(code.Code_UNAVAILABLE)},
+				CheckResponse: rejected,
+				HttpResponse:  &checkhttpv1.CheckHTTPResponse_DeniedResponse{DeniedResponse: &checkhttpv1.DeniedHttpResponse{Status: http.StatusForbidden}},
+			}}),
+			wantStatusCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rejection := tc.flow.RejectionError()
+			if rejection == nil {
+				t.Fatalf("RejectionError() = nil, want the flow rejected by its Check response")
+			}
+			if rejection.HTTPStatusCode != tc.wantStatusCode {
+				t.Errorf("HTTPStatusCode = %d, want %d", rejection.HTTPStatusCode, tc.wantStatusCode)
+			}
+			if rejection.RetryAfter != time.Second {
+				t.Errorf("RetryAfter = %s, want 1s", rejection.RetryAfter)
+			}
+			if rejection.RejectReason != checkv1.CheckResponse_REJECT_REASON_RATE_LIMITED {
+				t.Errorf("RejectReason = %s, want %s", rejection.RejectReason, checkv1.CheckResponse_REJECT_REASON_RATE_LIMITED)
+			}
+		})
+	}
+
+	flow := aperturetest.NewFlow(aperturetest.FlowOptions{Reject: true, CheckResponse: &checkv1.CheckResponse{
+		DecisionType: checkv1.CheckResponse_DECISION_TYPE_ACCEPTED,
+	}})
+	if !flow.ShouldRun() {
+		t.Errorf("ShouldRun() = false, want the decision of the accepted Check response")
+	}
+	if got := flow.HTTPResponseCode(); got != http.StatusOK {
+		t.Errorf("HTTPResponseCode() = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestFlowRecordsCacheCalls(t *testing.T) {
+	flow := aperturetest.NewFlow(aperturetest.FlowOptions{ControlPoint: "cached"})
+	if got := flow.ResultCache().LookupStatus(); got != aperture.LookupStatusMiss {
+		t.Errorf("ResultCache() status = %s, want %s", got, aperture.LookupStatusMiss)
+	}
+
+	flow.SetResultCache(context.Background(), aperture.CacheEntry{Value: []byte("42"), TTL: time.Minute})
+	flow.DeleteGlobalCache(context.Background(), "key")
+	if got := string(flow.ResultCache().Value()); got != "42" {
+		t.Errorf("ResultCache() value = %q, want %q", got, "42")
+	}
+
+	calls := flow.CacheCalls()
+	if len(calls) != 2 || calls[0].Operation != aperturetest.CacheOperationSetResult || calls[1].Operation != aperturetest.CacheOperationDeleteGlobal {
+		t.Errorf("CacheCalls() = %v, want SetResultCache then DeleteGlobalCache", calls)
+	}
+
+	flow.AssertNotEnded(t)
+	flow.End()
+	if res := flow.End(); res.Error == nil {
+		t.Errorf("second End() error = nil, want error")
+	}
+	if got := len(flow.EndStatuses()); got != 2 {
+		t.Errorf("EndStatuses() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,365 @@
+package aperturetest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// errFlowAlreadyEnded is returned by End when the flow has already ended, like the flows of the SDK do.
+var errFlowAlreadyEnded = errors.New("flow already ended")
+
+// FlowOptions configure a Flow or HTTPFlow test double. The zero value describes an accepted flow.
+type FlowOptions struct {
+	// ControlPoint is the control point of the flow.
+	ControlPoint string
+	// Reject makes ShouldRun return false.
+	Reject bool
+	// DecisionSource is the path which made the decision.
+	DecisionSource aperture.DecisionSource
+	// Err is returned by Error.
+	Err error
+	// RetryAfter is the retry-after duration of a rejected flow.
+	RetryAfter time.Duration
+	// HTTPStatusCode is the HTTP status code of a rejected flow.
+	// Defaults to 429 Too Many Requests, or to 503 Service Unavailable if the flow was not rejected by Aperture Agent.
+	HTTPStatusCode int
+	// CheckResponse is returned by Flow.CheckResponse.
+	// If set, Reject, RetryAfter and HTTPStatusCode of a Flow are derived from it, the way the SDK does.
+	CheckResponse *checkv1.CheckResponse
+	// CheckHTTPResponse is returned by HTTPFlow.CheckResponse.
+	// If set, Reject, RetryAfter and HTTPStatusCode of an HTTPFlow are derived from it, the way the SDK does.
+	CheckHTTPResponse *checkhttpv1.CheckHTTPResponse
+	// ResultCache is the value of the result cache entry of the flow. Nil means a result cache miss.
+	ResultCache []byte
+	// GlobalCache are the values of the global cache entries of the flow. Missing keys are global cache misses.
+	GlobalCache map[string][]byte
+	// Span is returned by Span. Defaults to a no-op span.
+	Span trace.Span
+}
+
+// CacheOperation is a cache call made on a Flow test double.
+type CacheOperation string
+
+// The cache calls recorded by Flow.
+const (
+	CacheOperationSetResult    CacheOperation = "SetResultCache"
+	CacheOperationDeleteResult CacheOperation = "DeleteResultCache"
+	CacheOperationSetGlobal    CacheOperation = "SetGlobalCache"
+	CacheOperationDeleteGlobal CacheOperation = "DeleteGlobalCache"
+)
+
+// CacheCall is a recorded cache call.
+type CacheCall struct {
+	Operation CacheOperation
+	// Key is the global cache key, empty for the result cache.
+	Key string
+	// Entry is the upserted entry, empty for deletes.
+	Entry aperture.CacheEntry
+}
+
+// flowRecorder records the calls common to Flow and HTTPFlow.
+type flowRecorder struct {
+	opts         FlowOptions
+	rejectReason checkv1.CheckResponse_RejectReason
+
+	mu          sync.Mutex
+	status      aperture.FlowStatus
+	statuses    []aperture.FlowStatus
+	endStatuses []aperture.FlowStatus
+}
+
+// newFlowRecorder returns a recorder of a flow with the given options.
+func newFlowRecorder(opts FlowOptions) flowRecorder {
+	if opts.Span == nil {
+		opts.Span = noop.Span{}
+	}
+	return flowRecorder{opts: opts}
+}
+
+// decideFrom derives the decision of the flow from its Check response.
+// deniedStatusCode is the status code of the denied HTTP response, if any, which takes precedence over the one of the Check response.
+func (r *flowRecorder) decideFrom(checkResponse *checkv1.CheckResponse, accepted bool, deniedStatusCode int) {
+	r.opts.Reject = !accepted
+	r.opts.RetryAfter = checkResponse.GetWaitTime().AsDuration()
+	r.opts.HTTPStatusCode = http.StatusTooManyRequests
+	if statusCode := checkResponse.GetDeniedResponseStatusCode(); statusCode != checkv1.StatusCode_Empty {
+		r.opts.HTTPStatusCode = int(statusCode)
+	}
+	if deniedStatusCode != 0 {
+		r.opts.HTTPStatusCode = deniedStatusCode
+	}
+	r.rejectReason = checkResponse.GetRejectReason()
+}
+
+// ShouldRun returns false if FlowOptions.Reject is set.
+func (r *flowRecorder) ShouldRun() bool {
+	return !r.opts.Reject
+}
+
+// SetStatus records the status of the flow.
+func (r *flowRecorder) SetStatus(status aperture.FlowStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+	r.statuses = append(r.statuses, status)
+}
+
+// Error returns FlowOptions.Err.
+func (r *flowRecorder) Error() error {
+	return r.opts.Err
+}
+
+// Span returns FlowOptions.Span.
+func (r *flowRecorder) Span() trace.Span {
+	return r.opts.Span
+}
+
+// DecisionSource returns FlowOptions.DecisionSource.
+func (r *flowRecorder) DecisionSource() aperture.DecisionSource {
+	return r.opts.DecisionSource
+}
+
+// RejectionError describes the rejection of the flow as configured by FlowOptions. Returns nil if the flow should run.
+func (r *flowRecorder) RejectionError() *aperture.RejectionError {
+	if !r.opts.Reject {
+		return nil
+	}
+	statusCode := r.opts.HTTPStatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusTooManyRequests
+		if r.opts.DecisionSource != aperture.DecisionSourceAgent {
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	return &aperture.RejectionError{
+		ControlPoint:   r.opts.ControlPoint,
+		DecisionSource: r.opts.DecisionSource,
+		RejectReason:   r.rejectReason,
+		RetryAfter:     r.opts.RetryAfter,
+		HTTPStatusCode: statusCode,
+		Err:            r.opts.Err,
+	}
+}
+
+// End records the end of the flow with its current status. Returns an error if the flow has already ended.
+func (r *flowRecorder) End() aperture.EndResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endStatuses = append(r.endStatuses, r.status)
+	if len(r.endStatuses) > 1 {
+		return aperture.EndResponse{Error: errFlowAlreadyEnded}
+	}
+	return aperture.EndResponse{}
+}
+
+// Statuses returns the statuses set with SetStatus, in order.
+func (r *flowRecorder) Statuses() []aperture.FlowStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]aperture.FlowStatus(nil), r.statuses...)
+}
+
+// EndStatuses returns the status of the flow at every End call, in order.
+func (r *flowRecorder) EndStatuses() []aperture.FlowStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]aperture.FlowStatus(nil), r.endStatuses...)
+}
+
+// AssertEnded fails the test unless the flow was ended exactly once, with the given status.
+func (r *flowRecorder) AssertEnded(t testing.TB, status aperture.FlowStatus) {
+	t.Helper()
+	endStatuses := r.EndStatuses()
+	if len(endStatuses) != 1 {
+		t.Errorf("flow at control point %q was ended %d times, want once", r.opts.ControlPoint, len(endStatuses))
+		return
+	}
+	if endStatuses[0] != status {
+		t.Errorf("flow at control point %q was ended with status %s, want %s", r.opts.ControlPoint, endStatuses[0], status)
+	}
+}
+
+// AssertNotEnded fails the test if the flow was ended.
+func (r *flowRecorder) AssertNotEnded(t testing.TB) {
+	t.Helper()
+	if endStatuses := r.EndStatuses(); len(endStatuses) > 0 {
+		t.Errorf("flow at control point %q was ended %d times, want none", r.opts.ControlPoint, len(endStatuses))
+	}
+}
+
+// Flow is a test double of aperture.Flow which records the calls made on it.
+type Flow struct {
+	flowRecorder
+
+	cacheMu     sync.Mutex
+	resultCache []byte
+	globalCache map[string][]byte
+	cacheCalls  []CacheCall
+}
+
+// Flow implements the aperture.Flow interface.
+var _ aperture.Flow = (*Flow)(nil)
+
+// NewFlow returns a Flow test double with the given options.
+func NewFlow(opts FlowOptions) *Flow {
+	globalCache := make(map[string][]byte, len(opts.GlobalCache))
+	for key, value := range opts.GlobalCache {
+		globalCache[key] = value
+	}
+	f := &Flow{
+		flowRecorder: newFlowRecorder(opts),
+		resultCache:  opts.ResultCache,
+		globalCache:  globalCache,
+	}
+	if res := opts.CheckResponse; res != nil {
+		f.decideFrom(res, res.GetDecisionType() == checkv1.CheckResponse_DECISION_TYPE_ACCEPTED, 0)
+	}
+	return f
+}
+
+// CheckResponse returns FlowOptions.CheckResponse.
+func (f *Flow) CheckResponse() *checkv1.CheckResponse {
+	return f.opts.CheckResponse
+}
+
+// RetryAfter returns FlowOptions.RetryAfter, or the wait time of FlowOptions.CheckResponse if set.
+func (f *Flow) RetryAfter() time.Duration {
+	return f.opts.RetryAfter
+}
+
+// HTTPResponseCode returns 200 for accepted flows, otherwise the HTTP status code of the rejection.
+func (f *Flow) HTTPResponseCode() int {
+	if rejection := f.RejectionError(); rejection != nil {
+		return rejection.HTTPStatusCode
+	}
+	return http.StatusOK
+}
+
+// Attempts returns 1.
+func (f *Flow) Attempts() int {
+	return 1
+}
+
+// ResultCache returns the result cache entry of the flow.
+func (f *Flow) ResultCache() aperture.KeyLookupResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	return newKeyLookupResponse(f.resultCache)
+}
+
+// SetResultCache records the call and stores the result cache entry of the flow.
+func (f *Flow) SetResultCache(ctx context.Context, cacheEntry aperture.CacheEntry, opts ...grpc.CallOption) aperture.KeyUpsertResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cacheCalls = append(f.cacheCalls, CacheCall{Operation: CacheOperationSetResult, Entry: cacheEntry})
+	f.resultCache = cacheEntry.Value
+	return cacheResponse{}
+}
+
+// DeleteResultCache records the call and deletes the result cache entry of the flow.
+func (f *Flow) DeleteResultCache(ctx context.Context, opts ...grpc.CallOption) aperture.KeyDeleteResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cacheCalls = append(f.cacheCalls, CacheCall{Operation: CacheOperationDeleteResult})
+	f.resultCache = nil
+	return cacheResponse{}
+}
+
+// GlobalCache returns a global cache entry of the flow.
+func (f *Flow) GlobalCache(key string) aperture.KeyLookupResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	return newKeyLookupResponse(f.globalCache[key])
+}
+
+// SetGlobalCache records the call and stores a global cache entry of the flow.
+func (f *Flow) SetGlobalCache(ctx context.Context, key string, cacheEntry aperture.CacheEntry, opts ...grpc.CallOption) aperture.KeyUpsertResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cacheCalls = append(f.cacheCalls, CacheCall{Operation: CacheOperationSetGlobal, Key: key, Entry: cacheEntry})
+	f.globalCache[key] = cacheEntry.Value
+	return cacheResponse{}
+}
+
+// DeleteGlobalCache records the call and deletes a global cache entry of the flow.
+func (f *Flow) DeleteGlobalCache(ctx context.Context, key string, opts ...grpc.CallOption) aperture.KeyDeleteResponse {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cacheCalls = append(f.cacheCalls, CacheCall{Operation: CacheOperationDeleteGlobal, Key: key})
+	delete(f.globalCache, key)
+	return cacheResponse{}
+}
+
+// CacheCalls returns the recorded cache calls, in order.
+func (f *Flow) CacheCalls() []CacheCall {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	return append([]CacheCall(nil), f.cacheCalls...)
+}
+
+// HTTPFlow is a test double of aperture.HTTPFlow which records the calls made on it.
+type HTTPFlow struct {
+	flowRecorder
+}
+
+// HTTPFlow implements the aperture.HTTPFlow interface.
+var _ aperture.HTTPFlow = (*HTTPFlow)(nil)
+
+// NewHTTPFlow returns an HTTPFlow test double with the given options.
+func NewHTTPFlow(opts FlowOptions) *HTTPFlow {
+	f := &HTTPFlow{flowRecorder: newFlowRecorder(opts)}
+	if res := opts.CheckHTTPResponse; res != nil {
+		f.decideFrom(res.GetCheckResponse(), res.GetStatus().GetCode() == int32(code.Code_OK), int(res.GetDeniedResponse().GetStatus()))
+	}
+	return f
+}
+
+// CheckResponse returns FlowOptions.CheckHTTPResponse.
+func (f *HTTPFlow) CheckResponse() *checkhttpv1.CheckHTTPResponse {
+	return f.opts.CheckHTTPResponse
+}
+
+// keyLookupResponse is the aperture.KeyLookupResponse of a Flow test double.
+type keyLookupResponse struct {
+	value []byte
+}
+
+// newKeyLookupResponse returns a hit for a non-nil value, otherwise a miss.
+func newKeyLookupResponse(value []byte) aperture.KeyLookupResponse {
+	return keyLookupResponse{value: value}
+}
+
+func (r keyLookupResponse) Value() []byte {
+	return r.value
+}
+
+func (r keyLookupResponse) LookupStatus() aperture.LookupStatus {
+	if r.value == nil {
+		return aperture.LookupStatusMiss
+	}
+	return aperture.LookupStatusHit
+}
+
+func (r keyLookupResponse) Error() error {
+	return nil
+}
+
+// cacheResponse is the successful aperture.KeyUpsertResponse and aperture.KeyDeleteResponse of a Flow test double.
+type cacheResponse struct{}
+
+func (cacheResponse) Error() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package aperturetest
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+)
+
+// GlobalCache is an in-memory test double of aperture.GlobalCache. Entries do not expire.
+type GlobalCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// GlobalCache implements the aperture.GlobalCache interface.
+var _ aperture.GlobalCache = (*GlobalCache)(nil)
+
+// NewGlobalCache returns an empty GlobalCache test double.
+func NewGlobalCache() *GlobalCache {
+	return &GlobalCache{entries: make(map[string][]byte)}
+}
+
+// Get returns the stored entries, misses for the others.
+func (gc *GlobalCache) Get(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]aperture.KeyLookupResponse {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	responses := make(map[string]aperture.KeyLookupResponse, len(keys))
+	for _, key := range keys {
+		responses[key] = newKeyLookupResponse(gc.entries[key])
+	}
+	return responses
+}
+
+// Set stores the entries.
+func (gc *GlobalCache) Set(ctx context.Context, entries map[string]aperture.CacheEntry, opts ...grpc.CallOption) map[string]aperture.KeyUpsertResponse {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	responses := make(map[string]aperture.KeyUpsertResponse, len(entries))
+	for key, entry := range entries {
+		gc.entries[key] = entry.Value
+		responses[key] = cacheResponse{}
+	}
+	return responses
+}
+
+// Delete deletes the entries.
+func (gc *GlobalCache) Delete(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]aperture.KeyDeleteResponse {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	responses := make(map[string]aperture.KeyDeleteResponse, len(keys))
+	for _, key := range keys {
+		delete(gc.entries, key)
+		responses[key] = cacheResponse{}
+	}
+	return responses
+}
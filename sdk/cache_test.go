@@ -0,0 +1,45 @@
+package aperture_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestLocalCacheServesFlowsDuringOutage(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		LocalCache: aperture.LocalCacheOptions{MaxEntries: 10},
+	})
+	ctx := context.Background()
+	flowParams := aperture.FlowParams{ResultCacheKey: "result", GlobalCacheKeys: []string{"global"}}
+
+	flow := client.StartFlow(ctx, "test", flowParams)
+	if err := flow.SetResultCache(ctx, aperture.CacheEntry{Value: []byte("result"), TTL: time.Minute}).Error(); err != nil {
+		t.Fatalf("SetResultCache() error = %v", err)
+	}
+	if err := flow.SetGlobalCache(ctx, "global", aperture.CacheEntry{Value: []byte("global"), TTL: time.Minute}).Error(); err != nil {
+		t.Fatalf("SetGlobalCache() error = %v", err)
+	}
+	flow.End()
+
+	agent.SetDefaultDecision(aperturetest.Decision{Err: errors.New("agent unavailable")})
+	flow = client.StartFlow(ctx, "test", flowParams)
+	defer flow.End()
+	if flow.Error() == nil || !flow.ShouldRun() {
+		t.Fatalf("Error() = %v, ShouldRun() = %t, want a flow failing open", flow.Error(), flow.ShouldRun())
+	}
+
+	if res := flow.ResultCache(); res.Error() != nil || res.LookupStatus() != aperture.LookupStatusHit || string(res.Value()) != "result" {
+		t.Errorf("ResultCache() = %q, %s, %v, want the local hit", res.Value(), res.LookupStatus(), res.Error())
+	}
+	if res := flow.GlobalCache("global"); res.Error() != nil || res.LookupStatus() != aperture.LookupStatusHit || string(res.Value()) != "global" {
+		t.Errorf("GlobalCache() = %q, %s, %v, want the local hit", res.Value(), res.LookupStatus(), res.Error())
+	}
+	if res := flow.GlobalCache("missing"); res.Error() == nil {
+		t.Errorf("GlobalCache() of a key missing locally error = nil, want the Check call error")
+	}
+}
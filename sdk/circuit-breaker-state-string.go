@@ -0,0 +1,82 @@
+// Code generated by "enumer -type=CircuitBreakerState -trimprefix=CircuitBreaker -output=circuit-breaker-state-string.go"; DO NOT EDIT.
+
+package aperture
+
+import (
+	"fmt"
+	"strings"
+)
+
+const _CircuitBreakerStateName = "ClosedOpenHalfOpen"
+
+var _CircuitBreakerStateIndex = [...]uint8{0, 6, 10, 18}
+
+const _CircuitBreakerStateLowerName = "closedopenhalfopen"
+
+func (i CircuitBreakerState) String() string {
+	if i >= CircuitBreakerState(len(_CircuitBreakerStateIndex)-1) {
+		return fmt.Sprintf("CircuitBreakerState(%d)", i)
+	}
+	return _CircuitBreakerStateName[_CircuitBreakerStateIndex[i]:_CircuitBreakerStateIndex[i+1]]
+}
+
+// An "invalid array index" compiler error signifies that the constant values have changed.
+// Re-run the stringer command to generate them again.
+func _CircuitBreakerStateNoOp() {
+	var x [1]struct{}
+	_ = x[CircuitBreakerClosed-(0)]
+	_ = x[CircuitBreakerOpen-(1)]
+	_ = x[CircuitBreakerHalfOpen-(2)]
+}
+
+var _CircuitBreakerStateValues = []CircuitBreakerState{CircuitBreakerClosed, CircuitBreakerOpen, CircuitBreakerHalfOpen}
+
+var _CircuitBreakerStateNameToValueMap = map[string]CircuitBreakerState{
+	_CircuitBreakerStateName[0:6]:        CircuitBreakerClosed,
+	_CircuitBreakerStateLowerName[0:6]:   CircuitBreakerClosed,
+	_CircuitBreakerStateName[6:10]:       CircuitBreakerOpen,
+	_CircuitBreakerStateLowerName[6:10]:  CircuitBreakerOpen,
+	_CircuitBreakerStateName[10:18]:      CircuitBreakerHalfOpen,
+	_CircuitBreakerStateLowerName[10:18]: CircuitBreakerHalfOpen,
+}
+
+var _CircuitBreakerStateNames = []string{
+	_CircuitBreakerStateName[0:6],
+	_CircuitBreakerStateName[6:10],
+	_CircuitBreakerStateName[10:18],
+}
+
+// CircuitBreakerStateString retrieves an enum value from the enum constants string name.
+// Throws an error if the param is not part of the enum.
+func CircuitBreakerStateString(s string) (CircuitBreakerState, error) {
+	if val, ok := _CircuitBreakerStateNameToValueMap[s]; ok {
+		return val, nil
+	}
+
+	if val, ok := _CircuitBreakerStateNameToValueMap[strings.ToLower(s)]; ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("%s does not belong to CircuitBreakerState values", s)
+}
+
+// CircuitBreakerStateValues returns all values of the enum
+func CircuitBreakerStateValues() []CircuitBreakerState {
+	return _CircuitBreakerStateValues
+}
+
+// CircuitBreakerStateStrings returns a slice of all String values of the enum
+func CircuitBreakerStateStrings() []string {
+	strs := make([]string, len(_CircuitBreakerStateNames))
+	copy(strs, _CircuitBreakerStateNames)
+	return strs
+}
+
+// IsACircuitBreakerState returns "true" if the value is listed in the enum definition. "false" otherwise
+func (i CircuitBreakerState) IsACircuitBreakerState() bool {
+	for _, v := range _CircuitBreakerStateValues {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitBreakerOpen is returned by Flow.Error() when the Check call was skipped because the circuit breaker is open.
+var ErrCircuitBreakerOpen = errors.New("circuit breaker is open")
+
+// defaultCircuitBreakerCooldown is the default time the circuit breaker stays open before it lets a probe through.
+const defaultCircuitBreakerCooldown = 10 * time.Second
+
+// CircuitBreakerState is the state of the circuit breaker around the Check calls to Aperture Agent.
+type CircuitBreakerState uint8
+
+// The circuit breaker opens after consecutive Check failures, skipping the calls until a half-open probe succeeds.
+//
+//go:generate enumer -type=CircuitBreakerState -trimprefix=CircuitBreaker -output=circuit-breaker-state-string.go
+const (
+	// CircuitBreakerClosed indicates that Check calls are performed.
+	CircuitBreakerClosed CircuitBreakerState = iota
+	// CircuitBreakerOpen indicates that Check calls are skipped.
+	CircuitBreakerOpen
+	// CircuitBreakerHalfOpen indicates that a single probe Check call is in progress.
+	CircuitBreakerHalfOpen
+)
+
+// CircuitBreakerOptions configures the circuit breaker around the Check calls to Aperture Agent.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive Check failures after which the circuit breaker opens. Zero disables the circuit breaker.
+	FailureThreshold int
+	// Cooldown is the time the circuit breaker stays open before a half-open probe Check call is let through. Defaults to 10s.
+	Cooldown time.Duration
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	opts     CircuitBreakerOptions
+	log      *slog.Logger
+	state    CircuitBreakerState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker creates a new circuit breaker in the closed state.
+func newCircuitBreaker(opts CircuitBreakerOptions, logger *slog.Logger) *circuitBreaker {
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		opts:  opts,
+		log:   logger,
+		state: CircuitBreakerClosed,
+	}
+}
+
+// allow returns whether a Check call should be performed.
+// Once the cooldown has elapsed, the first caller is let through as a half-open probe.
+func (cb *circuitBreaker) allow() bool {
+	if cb.opts.FailureThreshold <= 0 {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitBreakerOpen:
+		if time.Since(cb.openedAt) < cb.opts.Cooldown {
+			return false
+		}
+		cb.transition(CircuitBreakerHalfOpen)
+		return true
+	case CircuitBreakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record records the outcome of a Check call made with the caller's ctx.
+// Errors caused by the caller, whose ctx is done, or by the connection being closed are not counted as failures.
+func (cb *circuitBreaker) record(ctx context.Context, err error) {
+	if cb.opts.FailureThreshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		cb.failures = 0
+		if cb.state != CircuitBreakerClosed {
+			cb.transition(CircuitBreakerClosed)
+		}
+		return
+	}
+
+	if ctx.Err() != nil || status.Code(err) == codes.Canceled {
+		if cb.state == CircuitBreakerHalfOpen {
+			// The probe was abandoned, let another one through.
+			cb.transition(CircuitBreakerOpen)
+			cb.openedAt = time.Time{}
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitBreakerHalfOpen || (cb.state == CircuitBreakerClosed && cb.failures >= cb.opts.FailureThreshold) {
+		cb.transition(CircuitBreakerOpen)
+		cb.openedAt = time.Now()
+	}
+}
+
+// currentState returns the current state of the circuit breaker.
+func (cb *circuitBreaker) currentState() CircuitBreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// transition changes the state of the circuit breaker. Must be called with mu held.
+func (cb *circuitBreaker) transition(state CircuitBreakerState) {
+	if cb.state == state {
+		return
+	}
+	cb.log.Info("Aperture circuit breaker state changed.", "from", cb.state.String(), "to", state.String(), "consecutiveFailures", cb.failures)
+	cb.state = state
+}
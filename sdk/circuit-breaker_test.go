@@ -0,0 +1,89 @@
+package aperture_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		CircuitBreaker: aperture.CircuitBreakerOptions{FailureThreshold: 2, Cooldown: 50 * time.Millisecond},
+	})
+	startFlow := func() aperture.Flow {
+		flow := client.StartFlow(context.Background(), "test", aperture.FlowParams{})
+		flow.End()
+		return flow
+	}
+
+	agent.SetDefaultDecision(aperturetest.Decision{Err: status.Error(codes.Unavailable, "agent unavailable")})
+	startFlow()
+	if got := client.CircuitBreakerState(); got != aperture.CircuitBreakerClosed {
+		t.Fatalf("state after 1 failure = %s, want %s", got, aperture.CircuitBreakerClosed)
+	}
+	startFlow()
+	if got := client.CircuitBreakerState(); got != aperture.CircuitBreakerOpen {
+		t.Fatalf("state after 2 failures = %s, want %s", got, aperture.CircuitBreakerOpen)
+	}
+
+	if flow := startFlow(); !errors.Is(flow.Error(), aperture.ErrCircuitBreakerOpen) {
+		t.Errorf("Error() while open = %v, want ErrCircuitBreakerOpen", flow.Error())
+	}
+	if got := len(agent.CheckRequests()); got != 2 {
+		t.Errorf("Check requests = %d, want the calls skipped while open", got)
+	}
+
+	// Once the cooldown has elapsed, a successful probe closes the circuit breaker.
+	time.Sleep(60 * time.Millisecond)
+	agent.SetDefaultDecision(aperturetest.Decision{})
+	if flow := startFlow(); flow.Error() != nil {
+		t.Errorf("Error() of the probe = %v, want nil", flow.Error())
+	}
+	if got := client.CircuitBreakerState(); got != aperture.CircuitBreakerClosed {
+		t.Errorf("state after a successful probe = %s, want %s", got, aperture.CircuitBreakerClosed)
+	}
+}
+
+func TestCircuitBreakerFailedProbe(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		CircuitBreaker: aperture.CircuitBreakerOptions{FailureThreshold: 1, Cooldown: 50 * time.Millisecond},
+	})
+	agent.SetDefaultDecision(aperturetest.Decision{Err: status.Error(codes.Unavailable, "agent unavailable")})
+
+	client.StartFlow(context.Background(), "test", aperture.FlowParams{}).End()
+	time.Sleep(60 * time.Millisecond)
+	client.StartFlow(context.Background(), "test", aperture.FlowParams{}).End()
+
+	if got := client.CircuitBreakerState(); got != aperture.CircuitBreakerOpen {
+		t.Errorf("state after a failed probe = %s, want %s", got, aperture.CircuitBreakerOpen)
+	}
+	if got := len(agent.CheckRequests()); got != 2 {
+		t.Errorf("Check requests = %d, want 2", got)
+	}
+}
+
+func TestCircuitBreakerIgnoresCallerContext(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		CircuitBreaker: aperture.CircuitBreakerOptions{FailureThreshold: 1},
+	})
+	agent.SetDefaultDecision(aperturetest.Decision{Delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	client.StartFlow(ctx, "test", aperture.FlowParams{}).End()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.StartFlow(cancelled, "test", aperture.FlowParams{}).End()
+
+	if got := client.CircuitBreakerState(); got != aperture.CircuitBreakerClosed {
+		t.Errorf("state after calls abandoned by the caller = %s, want %s", got, aperture.CircuitBreakerClosed)
+	}
+}
@@ -2,20 +2,25 @@ package aperture
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"regexp"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/fluxninja/aperture-go/v2/sdk/utils"
 	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
@@ -29,6 +34,53 @@ type Options struct {
 	Address     string
 	APIKey      string
 	DialOptions []grpc.DialOption
+	// FallbackPolicies are local flow control policies keyed by control point, which are consulted only when the Check call to Aperture Agent fails.
+	FallbackPolicies map[string]FallbackPolicy
+	// FailureMode decides whether flows should run when the Check call fails. Can be overridden by FlowParams.FailureMode.
+	// If not set, flows fail to the FallbackPolicy of their control point, if any, or fail open.
+	FailureMode FailureMode
+	// MeterProvider is used to record the SDK metrics of flow decisions. Defaults to the global MeterProvider.
+	MeterProvider metric.MeterProvider
+	// CircuitBreaker configures the circuit breaker which skips the Check calls after consecutive failures. Disabled by default.
+	CircuitBreaker CircuitBreakerOptions
+	// CheckTimeout is the default timeout of the Check call, used unless FlowParams.Timeout or MiddlewareParams.Timeout is set.
+	// Zero means the Check call is bound only by the deadline of the passed context.
+	CheckTimeout time.Duration
+	// TracerProvider is used to create the flow spans instead of a dedicated provider exporting them to Aperture Agent.
+	// The flow spans need to reach Aperture Agent for it to complete the control loop. A provided TracerProvider is not shut down by Client.Shutdown.
+	TracerProvider trace.TracerProvider
+	// RegisterGlobalTracerProvider registers the dedicated provider exporting the flow spans to Aperture Agent as the global TracerProvider.
+	// By default, the global TracerProvider is left untouched.
+	RegisterGlobalTracerProvider bool
+	// OTLPAddress is the address of the OTLP receiver of Aperture Agent the flow spans are exported to.
+	// If empty, the flow spans are exported over the flow control connection to Address.
+	OTLPAddress string
+	// OTLPDialOptions are the grpc dial options used to connect to OTLPAddress.
+	OTLPDialOptions []grpc.DialOption
+	// SpanExporter exports the flow spans instead of the OTLP exporter. OTLPAddress and OTLPDialOptions are ignored if set.
+	SpanExporter sdktrace.SpanExporter
+	// SpanBatchOptions configure the batching of the exported flow spans.
+	SpanBatchOptions SpanBatchOptions
+	// AutoEndFlows ends flows with the Error status once the context passed to StartFlow or StartHTTPFlow is done, unless they have ended by then.
+	// This releases the slots held in Aperture Agent by flows whose End is never called, e.g. because of a panic.
+	AutoEndFlows bool
+	// LeakedFlowThreshold is the time after which a flow which has not ended is logged along with its control point and the stack it was started from.
+	// Zero disables the leaked flow detection.
+	LeakedFlowThreshold time.Duration
+	// LocalCache configures an in-process LRU cache in front of the result and global caches of Aperture Agent. Disabled by default.
+	LocalCache LocalCacheOptions
+}
+
+// SpanBatchOptions configure the batch span processor of the dedicated tracer provider. Zero values use the BatchSpanProcessor defaults.
+type SpanBatchOptions struct {
+	// MaxQueueSize is the maximum number of spans buffered before they are dropped.
+	MaxQueueSize int
+	// MaxExportBatchSize is the maximum number of spans exported in a single batch.
+	MaxExportBatchSize int
+	// BatchTimeout is the maximum delay before a batch of spans is exported.
+	BatchTimeout time.Duration
+	// ExportTimeout is the timeout of a single export.
+	ExportTimeout time.Duration
 }
 
 // MiddlewareParams is the interface for the middleware params.
@@ -37,6 +89,19 @@ type MiddlewareParams struct {
 	IgnoredPathsCompiled []*regexp.Regexp // New field for the compiled regex patterns
 	FlowParams           FlowParams
 	Timeout              time.Duration
+	// IsHTTPError classifies the status code written by the handler wrapped in the HTTP middleware.
+	// If it returns true, the flow is ended with the Error status. Defaults to classifying 5xx status codes as errors.
+	IsHTTPError func(statusCode int) bool
+	// GRPCErrorCodes are the gRPC status codes returned by the handler wrapped in the gRPC interceptors which end the flow with the Error status.
+	// Defaults to Unknown, DeadlineExceeded, Unimplemented, Internal, Unavailable and DataLoss.
+	GRPCErrorCodes []codes.Code
+	// FailClosedResponse is the response sent by the middlewares for flows which are rejected because the Check call failed.
+	FailClosedResponse FailClosedResponse
+	// PerMessageFlow enables gating of every message received on a gRPC stream as its own flow, in addition to the check performed when the stream is opened.
+	PerMessageFlow bool
+	// PerMessageFlowBody sends the JSON encoding of every message gated by PerMessageFlow as the request body of its flow,
+	// so that Aperture Agent can extract flow labels from it. Disabled by default, as every message would be encoded.
+	PerMessageFlowBody bool
 }
 
 // FlowParams is a struct that contains parameters for StartFlow call.
@@ -46,20 +111,31 @@ type FlowParams struct {
 	// CallOptions are the grpc call options that get passed to Aperture Agent via flowcontrolv1.Check call.
 	CallOptions []grpc.CallOption
 	// If RampMode is set to true, then flow must be accepted by at least 1 LoadRamp component.
+	// Flows in RampMode fail closed unless FailureMode is set.
 	RampMode bool
+	// FailureMode decides whether the flow should run when the Check call fails. Defaults to Options.FailureMode.
+	FailureMode FailureMode
 	// ResultCacheKey is key to the result cache entry which needs to be fetched at flow start.
 	ResultCacheKey string
 	// GlobalCacheKeys are keys to global cache entries that need to be fetched at flow start.
 	GlobalCacheKeys []string
+	// Timeout is the timeout of the Check call. Defaults to Options.CheckTimeout.
+	Timeout time.Duration
+	// RetryPolicy retries flows rejected by Aperture Agent with a retry-after duration. Used by StartFlow only, disabled by default.
+	RetryPolicy RetryPolicy
 }
 
 // Client is the interface that is provided to the user upon which they can perform Check calls for their service and eventually shut down in case of error.
 type Client interface {
 	StartFlow(ctx context.Context, controlPoint string, flowParams FlowParams) Flow
+	StartFlows(ctx context.Context, requests []FlowRequest, parallelism int) Flows
 	StartHTTPFlow(ctx context.Context, request *checkhttpv1.CheckHTTPRequest, middlewareParams MiddlewareParams) HTTPFlow
 	Shutdown(ctx context.Context) error
 	GetLogger() *slog.Logger
 	GetGRPClientConn() *grpc.ClientConn
+	CircuitBreakerState() CircuitBreakerState
+	LocalCacheStats() LocalCacheStats
+	GlobalCache() GlobalCache
 }
 
 type apertureClient struct {
@@ -67,13 +143,35 @@ type apertureClient struct {
 	flowControlClient     checkv1.FlowControlServiceClient
 	flowControlHTTPClient checkhttpv1.FlowControlServiceHTTPClient
 	tracer                trace.Tracer
-	exporter              *otlptrace.Exporter
+	tracerProvider        *sdktrace.TracerProvider
+	otlpConn              *grpc.ClientConn
 	log                   *slog.Logger
+	fallbackLimiters      map[string]*fallbackLimiter
+	circuitBreaker        *circuitBreaker
+	checkTimeout          time.Duration
+	failureMode           FailureMode
+	metrics               *metrics
+	flows                 *flowRegistry
+	autoEndFlows          bool
+	localCache            *localCache
+	globalCache           *globalCache
+	shutdownOnce          sync.Once
+	shutdownErr           error
 }
 
 // NewClient returns a new Client that can be used to perform Check calls.
-// The user will pass in options which will be used to create a connection with otel and a tracerProvider retrieved from such connection.
-func NewClient(ctx context.Context, opts Options) (Client, error) {
+// The user will pass in options which will be used to create a connection with Aperture Agent and, unless Options.TracerProvider is set,
+// a dedicated tracerProvider exporting the flow spans over such connection.
+func NewClient(ctx context.Context, opts Options) (_ Client, err error) {
+	meterProvider := opts.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	metrics, err := newMetrics(meterProvider)
+	if err != nil {
+		return nil, err
+	}
+
 	if opts.DialOptions == nil {
 		opts.DialOptions = []grpc.DialOption{}
 	}
@@ -85,30 +183,53 @@ func NewClient(ctx context.Context, opts Options) (Client, error) {
 			return invoker(ctx, method, req, reply, cc, callOpts...)
 		})
 		opts.DialOptions = append(opts.DialOptions, dialOptions)
+		opts.OTLPDialOptions = append(opts.OTLPDialOptions, dialOptions)
 	}
 
 	conn, err := grpc.DialContext(ctx, opts.Address, opts.DialOptions...)
 	if err != nil {
 		return nil, err
 	}
-
-	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
-	if err != nil {
-		return nil, err
+	var otlpConn *grpc.ClientConn
+	// Close the connections if the client cannot be created.
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+			if otlpConn != nil {
+				_ = otlpConn.Close()
+			}
+		}
+	}()
+
+	// The SDK owns, and therefore shuts down, only the tracer provider it creates itself.
+	var ownTracerProvider *sdktrace.TracerProvider
+	tracerProvider := opts.TracerProvider
+	if tracerProvider == nil {
+		exporter := opts.SpanExporter
+		if exporter == nil {
+			exporterConn := conn
+			if opts.OTLPAddress != "" {
+				otlpConn, err = grpc.DialContext(ctx, opts.OTLPAddress, opts.OTLPDialOptions...)
+				if err != nil {
+					return nil, err
+				}
+				exporterConn = otlpConn
+			}
+			exporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(exporterConn))
+			if err != nil {
+				return nil, err
+			}
+		}
+		ownTracerProvider, err = newTracerProvider(exporter, opts.SpanBatchOptions)
+		if err != nil {
+			return nil, err
+		}
+		if opts.RegisterGlobalTracerProvider {
+			otel.SetTracerProvider(ownTracerProvider)
+		}
+		tracerProvider = ownTracerProvider
 	}
 
-	res, err := newResource()
-	if err != nil {
-		return nil, err
-	}
-
-	tracerProvider := sdktrace.NewTracerProvider(
-		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(sdktrace.NewBatchSpanProcessor(exporter)),
-	)
-
-	otel.SetTracerProvider(tracerProvider)
-
 	tracer := tracerProvider.Tracer(libraryName)
 
 	var logger *slog.Logger
@@ -119,6 +240,7 @@ func NewClient(ctx context.Context, opts Options) (Client, error) {
 	}
 
 	fcClient := checkv1.NewFlowControlServiceClient(conn)
+	localCache := newLocalCache(opts.LocalCache)
 	fcHTTPClient := checkhttpv1.NewFlowControlServiceHTTPClient(conn)
 
 	c := &apertureClient{
@@ -126,26 +248,163 @@ func NewClient(ctx context.Context, opts Options) (Client, error) {
 		flowControlClient:     fcClient,
 		flowControlHTTPClient: fcHTTPClient,
 		tracer:                tracer,
-		exporter:              exporter,
+		tracerProvider:        ownTracerProvider,
+		otlpConn:              otlpConn,
 		log:                   logger,
+		fallbackLimiters:      newFallbackLimiters(opts.FallbackPolicies),
+		circuitBreaker:        newCircuitBreaker(opts.CircuitBreaker, logger),
+		checkTimeout:          opts.CheckTimeout,
+		failureMode:           opts.FailureMode,
+		metrics:               metrics,
+		flows:                 newFlowRegistry(opts.LeakedFlowThreshold, logger),
+		autoEndFlows:          opts.AutoEndFlows,
+		localCache:            localCache,
+		globalCache:           newGlobalCache(fcClient, localCache),
 	}
 	return c, nil
 }
 
 // getSpan constructs new flow tracer span.
+// The span is a child of the active span in ctx, so the flow can be associated with the caller's trace.
 func (c *apertureClient) getSpan(ctx context.Context) trace.Span {
-	_, span := c.tracer.Start(ctx, "Aperture Check", trace.WithAttributes(
-		attribute.Int64(flowStartTimestampLabel, time.Now().UnixNano()),
-		attribute.String(sourceLabel, "sdk"),
-	))
+	_, span := c.tracer.Start(ctx, "Aperture Check",
+		trace.WithAttributes(
+			attribute.Int64(flowStartTimestampLabel, time.Now().UnixNano()),
+			attribute.String(sourceLabel, "sdk"),
+		),
+	)
 	return span
 }
 
+// startCallerSpan starts a span covering the Check call and the workload in the caller's trace, so throttling delays show up inline in it.
+// The flow span is exported only to Aperture Agent when the client uses its dedicated tracer provider,
+// therefore the span is created with the tracer provider of the active span in ctx. Returns nil if there is no recording span in ctx.
+func (c *apertureClient) startCallerSpan(ctx context.Context, controlPoint string) trace.Span {
+	if c.tracerProvider == nil {
+		return nil
+	}
+	callerSpan := trace.SpanFromContext(ctx)
+	if !callerSpan.IsRecording() {
+		return nil
+	}
+	_, span := callerSpan.TracerProvider().Tracer(libraryName).Start(ctx, "Aperture Check",
+		trace.WithAttributes(attribute.String(controlPointLabel, controlPoint)),
+	)
+	return span
+}
+
+// recordCallerDecision records the flow decision on the span started by startCallerSpan.
+func recordCallerDecision(span trace.Span, shouldRun bool, decisionSource DecisionSource, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Bool(shouldRunLabel, shouldRun),
+		attribute.String(decisionSourceLabel, decisionSource.String()),
+	)
+	if err != nil {
+		span.RecordError(err)
+	}
+}
+
+// endCallerSpan ends the span started by startCallerSpan once the flow ends, recording its status.
+func endCallerSpan(span trace.Span, statusCode FlowStatus) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attribute.String(flowStatusLabel, statusCode.String()))
+	span.End()
+}
+
+// check performs the Check call unless the circuit breaker is open.
+// The call is bound by timeout, or by the default Check timeout if timeout is not set.
+func (c *apertureClient) check(ctx context.Context, req *checkv1.CheckRequest, timeout time.Duration, callOptions []grpc.CallOption) (*checkv1.CheckResponse, error) {
+	if !c.circuitBreaker.allow() {
+		return nil, ErrCircuitBreakerOpen
+	}
+	checkCtx, cancel := c.withCheckTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	res, err := c.flowControlClient.Check(checkCtx, req, callOptions...)
+	c.circuitBreaker.record(ctx, err)
+	err = wrapCheckError(ctx, err)
+	c.metrics.recordCheck(ctx, req.GetControlPoint(), time.Since(start), err)
+	return res, err
+}
+
+// checkHTTP performs the CheckHTTP call unless the circuit breaker is open.
+// The call is bound by timeout, or by the default Check timeout if timeout is not set.
+func (c *apertureClient) checkHTTP(ctx context.Context, req *checkhttpv1.CheckHTTPRequest, timeout time.Duration) (*checkhttpv1.CheckHTTPResponse, error) {
+	if !c.circuitBreaker.allow() {
+		return nil, ErrCircuitBreakerOpen
+	}
+	checkCtx, cancel := c.withCheckTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	res, err := c.flowControlHTTPClient.CheckHTTP(checkCtx, req)
+	c.circuitBreaker.record(ctx, err)
+	err = wrapCheckError(ctx, err)
+	c.metrics.recordCheck(ctx, req.GetControlPoint(), time.Since(start), err)
+	return res, err
+}
+
+// withCheckTimeout returns a context bound by timeout, or by the default Check timeout if timeout is not set.
+func (c *apertureClient) withCheckTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = c.checkTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// wrapCheckError wraps errors of Check calls which ran out of time with ErrCheckTimeout.
+// Errors caused by the caller's ctx being done, including its own deadline, are returned as is.
+func wrapCheckError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if status.Code(err) == codes.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrCheckTimeout, err)
+	}
+	return err
+}
+
 // StartFlow takes a control point name and labels that get passed to Aperture Agent via flowcontrolv1.Check call.
 // Return value is a Flow.
 // The call returns immediately in case connection with Aperture Agent is not established.
-// The default semantics are fail-to-wire. If StartFlow fails, calling Flow.ShouldRun() on returned Flow returns as true.
+// The Check call is bound by FlowParams.Timeout, or by Options.CheckTimeout if not set. If it runs out of time, Flow.Error() wraps ErrCheckTimeout.
+// If StartFlow fails, the FailureMode of the flow decides whether calling Flow.ShouldRun() on returned Flow returns as true.
+// The default semantics are fail-to-wire.
+// Flows rejected by Aperture Agent with a retry-after duration are retried according to FlowParams.RetryPolicy, ending the rejected flows.
 func (c *apertureClient) StartFlow(ctx context.Context, controlPoint string, flowParams FlowParams) Flow {
+	f := c.startFlow(ctx, controlPoint, flowParams, 1)
+	var waited time.Duration
+	for attempt := 2; attempt <= flowParams.RetryPolicy.MaxAttempts; attempt++ {
+		wait, ok := flowParams.RetryPolicy.wait(ctx, f, waited)
+		if !ok {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return f
+		case <-timer.C:
+		}
+		waited += wait
+
+		if endResponse := f.End(); endResponse.Error != nil {
+			c.log.Info("Aperture flow control end got error.", "error", endResponse.Error)
+		}
+		f = c.startFlow(ctx, controlPoint, flowParams, attempt)
+	}
+	return f
+}
+
+// startFlow performs a single attempt of StartFlow.
+func (c *apertureClient) startFlow(ctx context.Context, controlPoint string, flowParams FlowParams, attempt int) *flow {
 	labels := utils.LabelsFromCtx(ctx)
 
 	// Explicit labels override baggage
@@ -165,62 +424,167 @@ func (c *apertureClient) StartFlow(ctx context.Context, controlPoint string, flo
 	}
 
 	span := c.getSpan(ctx)
+	callerSpan := c.startCallerSpan(ctx, controlPoint)
 
 	f := newFlow(
 		c.flowControlClient,
 		span,
-		flowParams.RampMode,
+		controlPoint,
 		flowParams.ResultCacheKey,
 		flowParams.GlobalCacheKeys,
 		flowParams.CallOptions,
+		c.metrics,
+		c.localCache,
 	)
+	f.attempts = attempt
+	f.callerSpan = callerSpan
 
 	defer f.Span().SetAttributes(
 		attribute.Int64(workloadStartTimestampLabel, time.Now().UnixNano()),
 	)
 
-	res, err := c.flowControlClient.Check(ctx, req, flowParams.CallOptions...)
+	var res *checkv1.CheckResponse
+	err := ErrClientShutdown
+	if c.flows.add(f, controlPoint) {
+		c.trackFlow(ctx, f)
+		res, err = c.check(ctx, req, flowParams.Timeout, flowParams.CallOptions)
+	}
 	if err != nil {
+		var releaseFallback func()
 		f.err = err
+		f.decisionSource, f.failureAccepted, releaseFallback = c.failureDecision(controlPoint, labels, flowParams)
+		f.onEnd(releaseFallback)
 	} else {
 		f.checkResponse = res
 	}
 
+	f.workloadStart = time.Now()
+	c.metrics.recordStart(ctx, controlPoint, f.ShouldRun(), f.decisionSource)
+	recordCallerDecision(f.callerSpan, f.ShouldRun(), f.decisionSource, f.err)
+	f.markStarted()
+
 	return f
 }
 
 // StartHTTPFlow takes a control point name and labels that get passed to Aperture Agent via flowcontrolhttp.CheckHTTP call.
 // Return value is a HTTPFlow.
-// The default semantics are fail-to-wire. If StartHTTPFlow fails, calling HTTPFlow.ShouldRun() on returned HTTPFlow returns as true.
+// If StartHTTPFlow fails, the FailureMode of the flow decides whether calling HTTPFlow.ShouldRun() on returned HTTPFlow returns as true.
+// The default semantics are fail-to-wire.
 func (c *apertureClient) StartHTTPFlow(ctx context.Context, request *checkhttpv1.CheckHTTPRequest, middlewareParams MiddlewareParams) HTTPFlow {
 	span := c.getSpan(ctx)
+	callerSpan := c.startCallerSpan(ctx, request.GetControlPoint())
 
-	f := newHTTPFlow(span, middlewareParams.FlowParams, c.flowControlClient)
+	f := newHTTPFlow(span, request.GetControlPoint(), middlewareParams.FlowParams, c.flowControlClient, c.metrics)
+	f.callerSpan = callerSpan
 
 	defer f.Span().SetAttributes(
 		attribute.Int64(workloadStartTimestampLabel, time.Now().UnixNano()),
 	)
 
-	// create a timeoutCtx if middlewareParams.Timeout is set
-	if middlewareParams.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, middlewareParams.Timeout)
-		defer cancel()
+	timeout := middlewareParams.Timeout
+	if timeout <= 0 {
+		timeout = middlewareParams.FlowParams.Timeout
 	}
 
-	res, err := c.flowControlHTTPClient.CheckHTTP(ctx, request)
+	var res *checkhttpv1.CheckHTTPResponse
+	err := ErrClientShutdown
+	if c.flows.add(f, request.GetControlPoint()) {
+		c.trackFlow(ctx, f)
+		res, err = c.checkHTTP(ctx, request, timeout)
+	}
 	if err != nil {
+		var releaseFallback func()
 		f.err = err
+		f.decisionSource, f.failureAccepted, releaseFallback = c.failureDecision(request.GetControlPoint(), request.GetRequest().GetHeaders(), middlewareParams.FlowParams)
+		f.onEnd(releaseFallback)
 	} else {
 		f.checkResponse = res
 	}
 
+	f.workloadStart = time.Now()
+	c.metrics.recordStart(ctx, request.GetControlPoint(), f.ShouldRun(), f.decisionSource)
+	recordCallerDecision(f.callerSpan, f.ShouldRun(), f.decisionSource, f.err)
+	f.markStarted()
+
 	return f
 }
 
+// trackFlow unregisters a registered flow once it ends.
+// If Options.AutoEndFlows is set, the flow is ended with the Error status once ctx is done.
+func (c *apertureClient) trackFlow(ctx context.Context, f registeredFlow) {
+	f.onEnd(func() { c.flows.remove(f) })
+	if !c.autoEndFlows {
+		return
+	}
+	stop := context.AfterFunc(ctx, func() {
+		f.SetStatus(Error)
+		f.End()
+	})
+	f.onEnd(func() { stop() })
+}
+
 // Shutdown shuts down the aperture client.
+// Flows started after Shutdown is called are decided by their FailureMode without calling Aperture Agent, with Flow.Error() returning ErrClientShutdown.
+// In-flight flows are waited for until ctx is done, or for 10 seconds if ctx has no deadline, after which the remaining ones are ended with the Error status.
+// Flows whose Check call is still pending are not waited for, they end with the Error status once it returns.
+// Pending flow spans are then flushed if the client owns its tracer provider, and the connections to Aperture Agent are closed.
+// Subsequent calls do nothing and return the result of the first one.
 func (c *apertureClient) Shutdown(ctx context.Context) error {
-	return c.exporter.Shutdown(ctx)
+	c.shutdownOnce.Do(func() {
+		c.shutdownErr = c.shutdown(ctx)
+	})
+	return c.shutdownErr
+}
+
+// shutdown performs the Shutdown of the client, once.
+func (c *apertureClient) shutdown(ctx context.Context) error {
+	c.flows.close()
+	if ended := c.flows.drain(ctx, shutdownDrainTimeout); ended > 0 {
+		c.log.Warn("Aperture client shutdown ended in-flight flows with Error status.", "count", ended)
+	}
+
+	var err error
+	if c.tracerProvider != nil {
+		flushCtx := ctx
+		if ctx.Err() != nil {
+			// The deadline was used up waiting for in-flight flows, give the flush a grace period.
+			var cancel context.CancelFunc
+			flushCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), shutdownFlushTimeout)
+			defer cancel()
+		}
+		err = c.tracerProvider.Shutdown(flushCtx)
+	}
+	if c.otlpConn != nil {
+		err = errors.Join(err, c.otlpConn.Close())
+	}
+	return errors.Join(err, c.grpcClientConn.Close())
+}
+
+// newTracerProvider returns a tracer provider exporting spans in batches with the given exporter.
+func newTracerProvider(exporter sdktrace.SpanExporter, batchOptions SpanBatchOptions) (*sdktrace.TracerProvider, error) {
+	res, err := newResource()
+	if err != nil {
+		return nil, err
+	}
+
+	var batchSpanProcessorOptions []sdktrace.BatchSpanProcessorOption
+	if batchOptions.MaxQueueSize > 0 {
+		batchSpanProcessorOptions = append(batchSpanProcessorOptions, sdktrace.WithMaxQueueSize(batchOptions.MaxQueueSize))
+	}
+	if batchOptions.MaxExportBatchSize > 0 {
+		batchSpanProcessorOptions = append(batchSpanProcessorOptions, sdktrace.WithMaxExportBatchSize(batchOptions.MaxExportBatchSize))
+	}
+	if batchOptions.BatchTimeout > 0 {
+		batchSpanProcessorOptions = append(batchSpanProcessorOptions, sdktrace.WithBatchTimeout(batchOptions.BatchTimeout))
+	}
+	if batchOptions.ExportTimeout > 0 {
+		batchSpanProcessorOptions = append(batchSpanProcessorOptions, sdktrace.WithExportTimeout(batchOptions.ExportTimeout))
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(sdktrace.NewBatchSpanProcessor(exporter, batchSpanProcessorOptions...)),
+	), nil
 }
 
 // newResource returns a resource describing the running process, containing the library name and version.
@@ -249,3 +613,30 @@ func (c *apertureClient) GetLogger() *slog.Logger {
 func (c *apertureClient) GetGRPClientConn() *grpc.ClientConn {
 	return c.grpcClientConn
 }
+
+// CircuitBreakerState returns the state of the circuit breaker around the Check calls to Aperture Agent.
+// Always returns CircuitBreakerClosed if the circuit breaker is disabled.
+func (c *apertureClient) CircuitBreakerState() CircuitBreakerState {
+	return c.circuitBreaker.currentState()
+}
+
+// LocalCacheStats returns the counters of the local cache. All are zero if Options.LocalCache is not enabled.
+func (c *apertureClient) LocalCacheStats() LocalCacheStats {
+	return c.localCache.stats()
+}
+
+// GlobalCache returns the global cache of Aperture Agent, which can be used without starting a flow.
+func (c *apertureClient) GlobalCache() GlobalCache {
+	return c.globalCache
+}
+
+// ContextWithFlowSpan returns a copy of ctx carrying the span of the given Flow or HTTPFlow as the active span,
+// so that spans of the downstream work are nested under the flow span.
+// When the client uses its dedicated tracer provider, the flow span is exported only to Aperture Agent,
+// so the span covering the flow in the caller's trace is used instead, if there is one.
+func ContextWithFlowSpan(ctx context.Context, flow interface{ Span() trace.Span }) context.Context {
+	if f, ok := flow.(interface{ contextSpan() trace.Span }); ok {
+		return trace.ContextWithSpan(ctx, f.contextSpan())
+	}
+	return trace.ContextWithSpan(ctx, flow.Span())
+}
@@ -0,0 +1,284 @@
+package aperture_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+// newAgentClient returns a client connected to a fake agent, without shutting the client down once the test completes.
+func newAgentClient(t *testing.T, opts aperture.Options) (aperture.Client, *aperturetest.Agent) {
+	t.Helper()
+	agent := aperturetest.NewAgent()
+	t.Cleanup(agent.Close)
+	client, err := agent.NewClient(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return client, agent
+}
+
+func TestShutdownEndsInFlightFlows(t *testing.T) {
+	client, agent := newAgentClient(t, aperture.Options{})
+	flow := client.StartFlow(context.Background(), "leaked", aperture.FlowParams{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if got := len(agent.FlowEndRequests()); got != 1 {
+		t.Errorf("FlowEnd requests = %d, want 1", got)
+	}
+	if res := flow.End(); res.Error == nil {
+		t.Errorf("End() after Shutdown error = nil, want the flow already ended")
+	}
+}
+
+func TestShutdownWaitsForInFlightFlows(t *testing.T) {
+	client, agent := newAgentClient(t, aperture.Options{})
+	flow := client.StartFlow(context.Background(), "inflight", aperture.FlowParams{})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		flow.End()
+	}()
+	start := time.Now()
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Shutdown() took %s, want it to return once the flow ended", elapsed)
+	}
+	if got := len(agent.FlowEndRequests()); got != 1 {
+		t.Errorf("FlowEnd requests = %d, want 1", got)
+	}
+}
+
+func TestShutdownWithPendingCheck(t *testing.T) {
+	client, agent := newAgentClient(t, aperture.Options{})
+	agent.SetDefaultDecision(aperturetest.Decision{Delay: 3 * time.Second})
+
+	started := make(chan aperture.Flow)
+	go func() {
+		started <- client.StartFlow(context.Background(), "pending", aperture.FlowParams{})
+	}()
+	waitFor(t, func() bool { return len(agent.CheckRequests()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown() took %s, want it bounded by its deadline", elapsed)
+	}
+
+	flow := <-started
+	if res := flow.End(); res.Error == nil {
+		t.Errorf("End() after Shutdown error = nil, want the flow already ended")
+	}
+}
+
+func TestShutdownIsIdempotent(t *testing.T) {
+	client, _ := newAgentClient(t, aperture.Options{})
+
+	for i := 0; i < 2; i++ {
+		if err := client.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown() call %d error = %v", i+1, err)
+		}
+	}
+}
+
+func TestStartFlowAfterShutdown(t *testing.T) {
+	client, agent := newAgentClient(t, aperture.Options{})
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	flow := client.StartFlow(context.Background(), "late", aperture.FlowParams{})
+	defer flow.End()
+	if !errors.Is(flow.Error(), aperture.ErrClientShutdown) {
+		t.Errorf("Error() = %v, want %v", flow.Error(), aperture.ErrClientShutdown)
+	}
+	if got := len(agent.CheckRequests()); got != 0 {
+		t.Errorf("Check requests = %d, want 0", got)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        aperture.Options
+		flowParams  aperture.FlowParams
+		callerLimit time.Duration
+		want        bool
+	}{
+		{name: "client timeout", opts: aperture.Options{CheckTimeout: 10 * time.Millisecond}, want: true},
+		{name: "flow timeout", flowParams: aperture.FlowParams{Timeout: 10 * time.Millisecond}, want: true},
+		{name: "caller deadline", callerLimit: 10 * time.Millisecond, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, agent := aperturetest.NewTestClient(t, tc.opts)
+			agent.SetDefaultDecision(aperturetest.Decision{Delay: time.Second})
+
+			ctx := context.Background()
+			if tc.callerLimit > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.callerLimit)
+				defer cancel()
+			}
+			flow := client.StartFlow(ctx, "test", tc.flowParams)
+			defer flow.End()
+
+			if flow.Error() == nil {
+				t.Fatalf("Error() = nil, want the Check call to run out of time")
+			}
+			if got := errors.Is(flow.Error(), aperture.ErrCheckTimeout); got != tc.want {
+				t.Errorf("errors.Is(%v, ErrCheckTimeout) = %t, want %t", flow.Error(), got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAutoEndFlows(t *testing.T) {
+	for _, autoEnd := range []bool{false, true} {
+		t.Run(fmt.Sprintf("AutoEndFlows=%t", autoEnd), func(t *testing.T) {
+			meterProvider := newRecordingMeterProvider()
+			client, agent := aperturetest.NewTestClient(t, aperture.Options{AutoEndFlows: autoEnd, MeterProvider: meterProvider})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			flow := client.StartFlow(ctx, "test", aperture.FlowParams{})
+			cancel()
+
+			if !autoEnd {
+				time.Sleep(10 * time.Millisecond)
+				if got := len(agent.FlowEndRequests()); got != 0 {
+					t.Errorf("FlowEnd requests = %d, want the flow left to its caller", got)
+				}
+				flow.End()
+				return
+			}
+			waitFor(t, func() bool { return len(agent.FlowEndRequests()) == 1 })
+			errorEnds := meterProvider.value("aperture.sdk.workload.duration", attribute.String("control_point", "test"), attribute.String("flow_status", "Error"))
+			if errorEnds != 1 {
+				t.Errorf("flows ended with the Error status = %v, want 1", errorEnds)
+			}
+			if res := flow.End(); res.Error == nil {
+				t.Errorf("End() after the automatic end error = nil, want the flow already ended")
+			}
+		})
+	}
+}
+
+func TestLeakedFlowDetection(t *testing.T) {
+	logs := &syncBuffer{}
+	client, _ := aperturetest.NewTestClient(t, aperture.Options{
+		LeakedFlowThreshold: 10 * time.Millisecond,
+		Logger:              slog.New(slog.NewTextHandler(logs, nil)),
+	})
+
+	flow := client.StartFlow(context.Background(), "leaky", aperture.FlowParams{})
+	defer flow.End()
+
+	waitFor(t, func() bool { return strings.Contains(logs.String(), "it may have leaked") })
+	if out := logs.String(); !strings.Contains(out, "controlPoint=leaky") || !strings.Contains(out, "TestLeakedFlowDetection") {
+		t.Errorf("leak report = %q, want the control point and the stack starting the flow", out)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls condition until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// connRecorder is a grpc stats handler counting the connections opened and closed.
+type connRecorder struct {
+	mu     sync.Mutex
+	opened int
+	closed int
+}
+
+func (r *connRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (r *connRecorder) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (r *connRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (r *connRecorder) HandleConn(_ context.Context, s stats.ConnStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch s.(type) {
+	case *stats.ConnBegin:
+		r.opened++
+	case *stats.ConnEnd:
+		r.closed++
+	}
+}
+
+func (r *connRecorder) counts() (opened, closed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.opened, r.closed
+}
+
+func TestNewClientFailureClosesConnection(t *testing.T) {
+	agent := aperturetest.NewAgent()
+	t.Cleanup(agent.Close)
+	conns := &connRecorder{}
+
+	// The OTLP connection cannot be dialed without transport credentials.
+	_, err := aperture.NewClient(context.Background(), aperture.Options{
+		Address:     "agent",
+		DialOptions: append(agent.DialOptions(), grpc.WithBlock(), grpc.WithStatsHandler(conns)),
+		OTLPAddress: "otlp",
+	})
+	if err == nil {
+		t.Fatalf("NewClient() error = nil, want the OTLP dial error")
+	}
+	waitFor(t, func() bool {
+		opened, closed := conns.counts()
+		return opened == 1 && closed == 1
+	})
+}
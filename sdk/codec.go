@@ -0,0 +1,83 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes the values of a TypedCache.
+// Other formats, e.g. MessagePack or CBOR, can be plugged in by implementing Codec around their libraries.
+type Codec interface {
+	// Marshal encodes v.
+	Marshal(v any) ([]byte, error)
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON.
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v.
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob.
+type GobCodec struct{}
+
+// Marshal encodes v with encoding/gob.
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob data into v.
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ProtoCodec encodes protobuf messages in the protobuf wire format.
+// The values of a TypedCache using it must be pointers to generated message types, e.g. TypedCache[*pb.Message].
+type ProtoCodec struct{}
+
+// Marshal encodes the protobuf message v.
+func (ProtoCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("proto codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(message)
+}
+
+// Unmarshal decodes data into the protobuf message v, or into the message pointed to by v, allocating it if nil.
+func (ProtoCodec) Unmarshal(data []byte, v any) error {
+	if message, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, message)
+	}
+	pointer := reflect.ValueOf(v)
+	if pointer.Kind() != reflect.Pointer || pointer.IsNil() || pointer.Elem().Kind() != reflect.Pointer {
+		return fmt.Errorf("proto codec: %T is not a pointer to a proto.Message", v)
+	}
+	messagePointer := pointer.Elem()
+	if messagePointer.IsNil() {
+		messagePointer.Set(reflect.New(messagePointer.Type().Elem()))
+	}
+	message, ok := messagePointer.Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("proto codec: %T is not a pointer to a proto.Message", v)
+	}
+	return proto.Unmarshal(data, message)
+}
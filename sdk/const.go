@@ -18,4 +18,10 @@ const (
 	flowEndTimestampLabel = "aperture.flow_end_timestamp"
 	// Label to hold workload start timestamp in Unix nanoseconds since Epoch.
 	workloadStartTimestampLabel = "aperture.workload_start_timestamp"
+	// Label to hold control point of the flow.
+	controlPointLabel = "aperture.control_point"
+	// Label to hold whether the flow was accepted.
+	shouldRunLabel = "aperture.flow.should_run"
+	// Label to hold which path made the flow decision.
+	decisionSourceLabel = "aperture.flow.decision_source"
 )
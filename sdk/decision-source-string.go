@@ -0,0 +1,82 @@
+// Code generated by "enumer -type=DecisionSource -trimprefix=DecisionSource -output=decision-source-string.go"; DO NOT EDIT.
+
+package aperture
+
+import (
+	"fmt"
+	"strings"
+)
+
+const _DecisionSourceName = "AgentFailureModeFallback"
+
+var _DecisionSourceIndex = [...]uint8{0, 5, 16, 24}
+
+const _DecisionSourceLowerName = "agentfailuremodefallback"
+
+func (i DecisionSource) String() string {
+	if i >= DecisionSource(len(_DecisionSourceIndex)-1) {
+		return fmt.Sprintf("DecisionSource(%d)", i)
+	}
+	return _DecisionSourceName[_DecisionSourceIndex[i]:_DecisionSourceIndex[i+1]]
+}
+
+// An "invalid array index" compiler error signifies that the constant values have changed.
+// Re-run the stringer command to generate them again.
+func _DecisionSourceNoOp() {
+	var x [1]struct{}
+	_ = x[DecisionSourceAgent-(0)]
+	_ = x[DecisionSourceFailureMode-(1)]
+	_ = x[DecisionSourceFallback-(2)]
+}
+
+var _DecisionSourceValues = []DecisionSource{DecisionSourceAgent, DecisionSourceFailureMode, DecisionSourceFallback}
+
+var _DecisionSourceNameToValueMap = map[string]DecisionSource{
+	_DecisionSourceName[0:5]:        DecisionSourceAgent,
+	_DecisionSourceLowerName[0:5]:   DecisionSourceAgent,
+	_DecisionSourceName[5:16]:       DecisionSourceFailureMode,
+	_DecisionSourceLowerName[5:16]:  DecisionSourceFailureMode,
+	_DecisionSourceName[16:24]:      DecisionSourceFallback,
+	_DecisionSourceLowerName[16:24]: DecisionSourceFallback,
+}
+
+var _DecisionSourceNames = []string{
+	_DecisionSourceName[0:5],
+	_DecisionSourceName[5:16],
+	_DecisionSourceName[16:24],
+}
+
+// DecisionSourceString retrieves an enum value from the enum constants string name.
+// Throws an error if the param is not part of the enum.
+func DecisionSourceString(s string) (DecisionSource, error) {
+	if val, ok := _DecisionSourceNameToValueMap[s]; ok {
+		return val, nil
+	}
+
+	if val, ok := _DecisionSourceNameToValueMap[strings.ToLower(s)]; ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("%s does not belong to DecisionSource values", s)
+}
+
+// DecisionSourceValues returns all values of the enum
+func DecisionSourceValues() []DecisionSource {
+	return _DecisionSourceValues
+}
+
+// DecisionSourceStrings returns a slice of all String values of the enum
+func DecisionSourceStrings() []string {
+	strs := make([]string, len(_DecisionSourceNames))
+	copy(strs, _DecisionSourceNames)
+	return strs
+}
+
+// IsADecisionSource returns "true" if the value is listed in the enum definition. "false" otherwise
+func (i DecisionSource) IsADecisionSource() bool {
+	for _, v := range _DecisionSourceValues {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Code generated by "enumer -type=FailureMode -output=failure-mode-string.go"; DO NOT EDIT.
+
+package aperture
+
+import (
+	"fmt"
+	"strings"
+)
+
+const _FailureModeName = "FailureModeUnspecifiedFailOpenFailClosedFailToFallback"
+
+var _FailureModeIndex = [...]uint8{0, 22, 30, 40, 54}
+
+const _FailureModeLowerName = "failuremodeunspecifiedfailopenfailclosedfailtofallback"
+
+func (i FailureMode) String() string {
+	if i >= FailureMode(len(_FailureModeIndex)-1) {
+		return fmt.Sprintf("FailureMode(%d)", i)
+	}
+	return _FailureModeName[_FailureModeIndex[i]:_FailureModeIndex[i+1]]
+}
+
+// An "invalid array index" compiler error signifies that the constant values have changed.
+// Re-run the stringer command to generate them again.
+func _FailureModeNoOp() {
+	var x [1]struct{}
+	_ = x[FailureModeUnspecified-(0)]
+	_ = x[FailOpen-(1)]
+	_ = x[FailClosed-(2)]
+	_ = x[FailToFallback-(3)]
+}
+
+var _FailureModeValues = []FailureMode{FailureModeUnspecified, FailOpen, FailClosed, FailToFallback}
+
+var _FailureModeNameToValueMap = map[string]FailureMode{
+	_FailureModeName[0:22]:       FailureModeUnspecified,
+	_FailureModeLowerName[0:22]:  FailureModeUnspecified,
+	_FailureModeName[22:30]:      FailOpen,
+	_FailureModeLowerName[22:30]: FailOpen,
+	_FailureModeName[30:40]:      FailClosed,
+	_FailureModeLowerName[30:40]: FailClosed,
+	_FailureModeName[40:54]:      FailToFallback,
+	_FailureModeLowerName[40:54]: FailToFallback,
+}
+
+var _FailureModeNames = []string{
+	_FailureModeName[0:22],
+	_FailureModeName[22:30],
+	_FailureModeName[30:40],
+	_FailureModeName[40:54],
+}
+
+// FailureModeString retrieves an enum value from the enum constants string name.
+// Throws an error if the param is not part of the enum.
+func FailureModeString(s string) (FailureMode, error) {
+	if val, ok := _FailureModeNameToValueMap[s]; ok {
+		return val, nil
+	}
+
+	if val, ok := _FailureModeNameToValueMap[strings.ToLower(s)]; ok {
+		return val, nil
+	}
+	return 0, fmt.Errorf("%s does not belong to FailureMode values", s)
+}
+
+// FailureModeValues returns all values of the enum
+func FailureModeValues() []FailureMode {
+	return _FailureModeValues
+}
+
+// FailureModeStrings returns a slice of all String values of the enum
+func FailureModeStrings() []string {
+	strs := make([]string, len(_FailureModeNames))
+	copy(strs, _FailureModeNames)
+	return strs
+}
+
+// IsAFailureMode returns "true" if the value is listed in the enum definition. "false" otherwise
+func (i FailureMode) IsAFailureMode() bool {
+	for _, v := range _FailureModeValues {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package aperture
+
+// FailureMode decides whether a flow should run when the Check call to Aperture Agent fails.
+type FailureMode uint8
+
+// FailureModeUnspecified inherits the failure mode from the next level of configuration.
+//
+//go:generate enumer -type=FailureMode -output=failure-mode-string.go
+const (
+	// FailureModeUnspecified defers to Options.FailureMode, or to the default semantics if not set there either.
+	FailureModeUnspecified FailureMode = iota
+	// FailOpen accepts the flow.
+	FailOpen
+	// FailClosed rejects the flow.
+	FailClosed
+	// FailToFallback lets the FallbackPolicy of the control point decide. Fails open if the control point has no FallbackPolicy.
+	FailToFallback
+)
+
+// FailClosedResponse is the response sent by the middlewares for flows which are rejected because the Check call failed.
+type FailClosedResponse struct {
+	// StatusCode is the HTTP status code of the response. Defaults to 503 Service Unavailable.
+	// The gRPC interceptors convert it to the corresponding gRPC status code.
+	StatusCode int
+	// Headers are the HTTP headers of the response.
+	Headers map[string]string
+	// Body is the body of the response.
+	Body string
+}
+
+// resolveFailureMode returns the failure mode of a flow.
+// FlowParams.FailureMode takes precedence. Otherwise, flows in RampMode fail closed, and remaining flows use Options.FailureMode.
+// If that is not set either, flows fail to the FallbackPolicy of the control point, if any, or fail open.
+func (c *apertureClient) resolveFailureMode(controlPoint string, flowParams FlowParams) FailureMode {
+	if flowParams.FailureMode != FailureModeUnspecified {
+		return flowParams.FailureMode
+	}
+	if flowParams.RampMode {
+		return FailClosed
+	}
+	if c.failureMode != FailureModeUnspecified {
+		return c.failureMode
+	}
+	if _, ok := c.fallbackLimiters[controlPoint]; ok {
+		return FailToFallback
+	}
+	return FailOpen
+}
+
+// failureDecision decides whether a flow should run after the Check call failed.
+// If the flow is accepted by a FallbackPolicy, the returned release function must be called once the flow ends.
+func (c *apertureClient) failureDecision(controlPoint string, labels map[string]string, flowParams FlowParams) (DecisionSource, bool, func()) {
+	switch c.resolveFailureMode(controlPoint, flowParams) {
+	case FailClosed:
+		return DecisionSourceFailureMode, false, nil
+	case FailToFallback:
+		if limiter, ok := c.fallbackLimiters[controlPoint]; ok {
+			accepted, release := limiter.acquire(labels)
+			return DecisionSourceFallback, accepted, release
+		}
+	}
+	return DecisionSourceFailureMode, true, nil
+}
@@ -0,0 +1,82 @@
+package aperture_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+// newUnavailableAgentClient returns a client connected to a fake agent whose Check calls fail.
+func newUnavailableAgentClient(t *testing.T, opts aperture.Options) aperture.Client {
+	t.Helper()
+	client, agent := aperturetest.NewTestClient(t, opts)
+	agent.SetDefaultDecision(aperturetest.Decision{Err: errors.New("agent unavailable")})
+	return client
+}
+
+func TestFailureModes(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		opts       aperture.Options
+		flowParams aperture.FlowParams
+		want       bool
+	}{
+		{name: "default", want: true},
+		{name: "client fail closed", opts: aperture.Options{FailureMode: aperture.FailClosed}, want: false},
+		{name: "flow fail open", opts: aperture.Options{FailureMode: aperture.FailClosed}, flowParams: aperture.FlowParams{FailureMode: aperture.FailOpen}, want: true},
+		{name: "ramp mode", flowParams: aperture.FlowParams{RampMode: true}, want: false},
+		{name: "fallback without policy", flowParams: aperture.FlowParams{FailureMode: aperture.FailToFallback}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newUnavailableAgentClient(t, tc.opts)
+			flow := client.StartFlow(context.Background(), "test", tc.flowParams)
+			defer flow.End()
+
+			if flow.Error() == nil {
+				t.Errorf("Error() = nil, want the Check call error")
+			}
+			if got := flow.ShouldRun(); got != tc.want {
+				t.Errorf("ShouldRun() = %t, want %t", got, tc.want)
+			}
+			if got := flow.DecisionSource(); got != aperture.DecisionSourceFailureMode {
+				t.Errorf("DecisionSource() = %s, want %s", got, aperture.DecisionSourceFailureMode)
+			}
+		})
+	}
+}
+
+func TestFallbackPolicy(t *testing.T) {
+	client := newUnavailableAgentClient(t, aperture.Options{
+		FallbackPolicies: map[string]aperture.FallbackPolicy{
+			"test": {MaxConcurrency: 1, LimitByLabelKey: "user"},
+		},
+	})
+	startFlow := func(user string) aperture.Flow {
+		return client.StartFlow(context.Background(), "test", aperture.FlowParams{Labels: map[string]string{"user": user}})
+	}
+
+	first := startFlow("a")
+	if !first.ShouldRun() || first.DecisionSource() != aperture.DecisionSourceFallback {
+		t.Fatalf("first flow: ShouldRun() = %t, DecisionSource() = %s, want admitted by the fallback policy", first.ShouldRun(), first.DecisionSource())
+	}
+	second := startFlow("a")
+	if second.ShouldRun() {
+		t.Errorf("second flow of the same user admitted above the concurrency limit")
+	}
+	second.End()
+	other := startFlow("b")
+	if !other.ShouldRun() {
+		t.Errorf("flow of another user rejected, want it limited separately")
+	}
+	other.End()
+
+	first.End()
+	third := startFlow("a")
+	if !third.ShouldRun() {
+		t.Errorf("flow started after the first one ended rejected, want admitted")
+	}
+	third.End()
+}
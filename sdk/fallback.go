@@ -0,0 +1,168 @@
+package aperture
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// DecisionSource describes which path made the decision whether a flow should run.
+type DecisionSource uint8
+
+// The decision is made by Aperture Agent unless the Check call fails.
+//
+//go:generate enumer -type=DecisionSource -trimprefix=DecisionSource -output=decision-source-string.go
+const (
+	// DecisionSourceAgent indicates that the decision was made by Aperture Agent.
+	DecisionSourceAgent DecisionSource = iota
+	// DecisionSourceFailureMode indicates that the Check call failed and the decision was made by the FailureMode of the flow.
+	DecisionSourceFailureMode
+	// DecisionSourceFallback indicates that the Check call failed and the decision was made by the local FallbackPolicy of the control point.
+	DecisionSourceFallback
+)
+
+// FallbackPolicy is an in-process flow control policy for a control point, which is consulted only when the Check call to Aperture Agent fails
+// and the FailureMode of the flow is FailToFallback.
+// Token bucket and concurrency limits can be used on their own or combined, in which case a flow has to pass both.
+type FallbackPolicy struct {
+	// RateLimit is the number of flows per second admitted by the token bucket. Zero disables the token bucket.
+	RateLimit float64
+	// BucketCapacity is the maximum number of tokens in the token bucket, which allows bursts above RateLimit. Defaults to RateLimit.
+	BucketCapacity float64
+	// MaxConcurrency is the maximum number of flows admitted by the fallback policy which have not ended yet. Zero disables the concurrency limit.
+	MaxConcurrency int
+	// LimitByLabelKey is the flow label whose values are limited separately. If empty, all flows of the control point share the same limits.
+	LimitByLabelKey string
+}
+
+const (
+	// maxFallbackBuckets bounds the number of label values tracked separately by a fallbackLimiter.
+	// Flows with further label values share a single overflow bucket.
+	maxFallbackBuckets = 10000
+	// fallbackBucketSweepInterval is how often idle buckets are evicted from a fallbackLimiter.
+	fallbackBucketSweepInterval = time.Minute
+)
+
+// fallbackLimiter enforces a FallbackPolicy for a single control point.
+// Buckets which are back to their initial state, i.e. full and without flows in flight, are evicted, as recreating them is equivalent.
+type fallbackLimiter struct {
+	policy    FallbackPolicy
+	mu        sync.Mutex
+	buckets   map[string]*fallbackBucket
+	overflow  *fallbackBucket
+	lastSweep time.Time
+}
+
+// fallbackBucket holds the token bucket and concurrency state for a single label value.
+type fallbackBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	inflight   int
+}
+
+// newFallbackLimiters creates a fallbackLimiter for every control point with a FallbackPolicy.
+func newFallbackLimiters(policies map[string]FallbackPolicy) map[string]*fallbackLimiter {
+	limiters := make(map[string]*fallbackLimiter, len(policies))
+	for controlPoint, policy := range policies {
+		if policy.BucketCapacity <= 0 {
+			policy.BucketCapacity = math.Max(policy.RateLimit, 1)
+		}
+		limiters[controlPoint] = &fallbackLimiter{
+			policy:    policy,
+			buckets:   make(map[string]*fallbackBucket),
+			lastSweep: time.Now(),
+		}
+	}
+	return limiters
+}
+
+// acquire decides whether a flow with the given labels is admitted.
+// If the flow is admitted, the returned release function must be called once the flow ends.
+func (l *fallbackLimiter) acquire(labels map[string]string) (bool, func()) {
+	key := ""
+	if l.policy.LimitByLabelKey != "" {
+		key = labels[l.policy.LimitByLabelKey]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket := l.bucket(key, now)
+
+	if l.policy.MaxConcurrency > 0 && bucket.inflight >= l.policy.MaxConcurrency {
+		return false, nil
+	}
+
+	if l.policy.RateLimit > 0 {
+		elapsed := now.Sub(bucket.lastRefill).Seconds()
+		bucket.tokens = math.Min(l.policy.BucketCapacity, bucket.tokens+elapsed*l.policy.RateLimit)
+		bucket.lastRefill = now
+		if bucket.tokens < 1 {
+			return false, nil
+		}
+		bucket.tokens--
+	}
+
+	if l.policy.MaxConcurrency <= 0 {
+		return true, nil
+	}
+
+	bucket.inflight++
+	var once sync.Once
+	return true, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			bucket.inflight--
+		})
+	}
+}
+
+// bucket returns the bucket of a label value, creating it if needed. l.mu must be held.
+// Idle buckets are swept periodically, or when the limit on the number of buckets is reached.
+func (l *fallbackLimiter) bucket(key string, now time.Time) *fallbackBucket {
+	if bucket, ok := l.buckets[key]; ok {
+		return bucket
+	}
+
+	if len(l.buckets) >= maxFallbackBuckets || now.Sub(l.lastSweep) >= fallbackBucketSweepInterval {
+		for k, bucket := range l.buckets {
+			if l.idle(bucket, now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	if len(l.buckets) >= maxFallbackBuckets {
+		if l.overflow == nil {
+			l.overflow = l.newBucket(now)
+		}
+		return l.overflow
+	}
+
+	bucket := l.newBucket(now)
+	l.buckets[key] = bucket
+	return bucket
+}
+
+// newBucket returns a full bucket.
+func (l *fallbackLimiter) newBucket(now time.Time) *fallbackBucket {
+	return &fallbackBucket{
+		tokens:     l.policy.BucketCapacity,
+		lastRefill: now,
+	}
+}
+
+// idle reports whether bucket has no flows in flight and its token bucket has refilled, so that it can be evicted.
+func (l *fallbackLimiter) idle(bucket *fallbackBucket, now time.Time) bool {
+	if bucket.inflight > 0 {
+		return false
+	}
+	if l.policy.RateLimit <= 0 {
+		return true
+	}
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	return bucket.tokens+elapsed*l.policy.RateLimit >= l.policy.BucketCapacity
+}
@@ -0,0 +1,57 @@
+package aperture
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFallbackLimiterEvictsIdleBuckets(t *testing.T) {
+	limiter := newFallbackLimiters(map[string]FallbackPolicy{
+		"test": {RateLimit: 1000, MaxConcurrency: 1, LimitByLabelKey: "user"},
+	})["test"]
+
+	_, releaseA := limiter.acquire(map[string]string{"user": "a"})
+	_, releaseB := limiter.acquire(map[string]string{"user": "b"})
+	releaseB()
+
+	// Let the token bucket of b refill and force a sweep on the next new label value.
+	time.Sleep(5 * time.Millisecond)
+	limiter.lastSweep = time.Now().Add(-fallbackBucketSweepInterval)
+	limiter.acquire(map[string]string{"user": "c"})
+
+	if _, ok := limiter.buckets["a"]; !ok {
+		t.Errorf("bucket with a flow in flight was evicted")
+	}
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Errorf("idle bucket was not evicted")
+	}
+	if admitted, _ := limiter.acquire(map[string]string{"user": "a"}); admitted {
+		t.Errorf("flow admitted above the concurrency limit of a surviving bucket")
+	}
+	releaseA()
+}
+
+func TestFallbackLimiterIsBounded(t *testing.T) {
+	limiter := newFallbackLimiters(map[string]FallbackPolicy{
+		"test": {MaxConcurrency: 1, LimitByLabelKey: "user"},
+	})["test"]
+
+	for i := 0; i < maxFallbackBuckets; i++ {
+		if admitted, _ := limiter.acquire(map[string]string{"user": strconv.Itoa(i)}); !admitted {
+			t.Fatalf("flow %d rejected, want admitted", i)
+		}
+	}
+
+	admitted, release := limiter.acquire(map[string]string{"user": "overflow-1"})
+	if !admitted {
+		t.Fatalf("first overflow flow rejected, want admitted")
+	}
+	if admitted, _ := limiter.acquire(map[string]string{"user": "overflow-2"}); admitted {
+		t.Errorf("second overflow flow admitted, want it to share the limits of the first one")
+	}
+	if got := len(limiter.buckets); got != maxFallbackBuckets {
+		t.Errorf("buckets = %d, want %d", got, maxFallbackBuckets)
+	}
+	release()
+}
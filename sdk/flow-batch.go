@@ -0,0 +1,60 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultStartFlowsParallelism is the number of concurrent Check calls made by StartFlows unless set.
+const defaultStartFlowsParallelism = 16
+
+// FlowRequest describes a flow started by StartFlows.
+type FlowRequest struct {
+	// ControlPoint is the control point of the flow.
+	ControlPoint string
+	// FlowParams are the parameters of the flow, the same as for StartFlow.
+	FlowParams FlowParams
+}
+
+// Flows are the flows started by StartFlows, in the order of their FlowRequests.
+type Flows []Flow
+
+// EndAll ends all the flows, returning the errors of the flows which failed to end, joined.
+func (fs Flows) EndAll() error {
+	var errs []error
+	for _, f := range fs {
+		if endResponse := f.End(); endResponse.Error != nil {
+			errs = append(errs, endResponse.Error)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartFlows starts a flow for every request, the same as StartFlow would, making at most parallelism Check calls concurrently.
+// The concurrent Check calls are multiplexed over the connection to Aperture Agent. A non-positive parallelism defaults to 16.
+func (c *apertureClient) StartFlows(ctx context.Context, requests []FlowRequest, parallelism int) Flows {
+	if parallelism <= 0 {
+		parallelism = defaultStartFlowsParallelism
+	}
+	flows := make(Flows, len(requests))
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallelism, len(requests)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(requests) {
+					return
+				}
+				flows[i] = c.StartFlow(ctx, requests[i].ControlPoint, requests[i].FlowParams)
+			}
+		}()
+	}
+	wg.Wait()
+	return flows
+}
@@ -0,0 +1,71 @@
+package aperture_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestStartFlows(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDecision("rejected", aperturetest.Decision{Reject: true})
+
+	var requests []aperture.FlowRequest
+	for i := 0; i < 6; i++ {
+		controlPoint := "accepted"
+		if i%2 == 1 {
+			controlPoint = "rejected"
+		}
+		requests = append(requests, aperture.FlowRequest{
+			ControlPoint: controlPoint,
+			FlowParams:   aperture.FlowParams{Labels: map[string]string{"index": fmt.Sprint(i)}},
+		})
+	}
+
+	flows := client.StartFlows(context.Background(), requests, 0)
+	if len(flows) != len(requests) {
+		t.Fatalf("flows = %d, want %d", len(flows), len(requests))
+	}
+	for i, flow := range flows {
+		if want := i%2 == 0; flow.ShouldRun() != want {
+			t.Errorf("flows[%d].ShouldRun() = %t, want %t, in the order of the requests", i, flow.ShouldRun(), want)
+		}
+	}
+	if got := len(agent.CheckRequests()); got != len(requests) {
+		t.Errorf("Check requests = %d, want %d", got, len(requests))
+	}
+	if err := flows.EndAll(); err != nil {
+		t.Errorf("EndAll() error = %v", err)
+	}
+	if err := flows.EndAll(); err == nil {
+		t.Errorf("second EndAll() error = nil, want the errors of the flows already ended")
+	}
+}
+
+func TestStartFlowsParallelism(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDefaultDecision(aperturetest.Decision{Delay: 20 * time.Millisecond})
+	requests := make([]aperture.FlowRequest, 4)
+	for i := range requests {
+		requests[i] = aperture.FlowRequest{ControlPoint: "test"}
+	}
+
+	start := time.Now()
+	flows := client.StartFlows(context.Background(), requests, 2)
+	elapsed := time.Since(start)
+	defer flows.EndAll()
+
+	// 4 Check calls of 20ms, 2 at a time, take at least 40ms.
+	if elapsed < 40*time.Millisecond {
+		t.Errorf("StartFlows() took %s, want at most 2 concurrent Check calls", elapsed)
+	}
+	for i, flow := range flows {
+		if flow.Error() != nil {
+			t.Errorf("flows[%d].Error() = %v, want nil", i, flow.Error())
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrClientShutdown is returned by Flow.Error() for flows started after the client was shut down.
+// Such flows are decided by their FailureMode without calling Aperture Agent.
+var ErrClientShutdown = errors.New("aperture client is shut down")
+
+// shutdownFlushTimeout bounds flushing the flow spans on shutdown if the deadline was used up waiting for in-flight flows.
+const shutdownFlushTimeout = 5 * time.Second
+
+// shutdownDrainTimeout bounds the wait for in-flight flows on shutdown if the context has no deadline.
+const shutdownDrainTimeout = 10 * time.Second
+
+// shutdownFlowEndReserve is the part of the shutdown deadline kept for reporting the end of the flows ended by the drain, at most half of it.
+const shutdownFlowEndReserve = time.Second
+
+// maxRegisteredFlows bounds the number of flows tracked by the registry, so that flows which never end cannot grow it without bound.
+// Flows started while the registry is full are not drained on shutdown nor reported if they leak.
+const maxRegisteredFlows = 100000
+
+// registeredFlow is a flow started by the client which has not ended yet.
+type registeredFlow interface {
+	SetStatus(status FlowStatus)
+	End() EndResponse
+	endContext(ctx context.Context) EndResponse
+	afterStart(fn func()) bool
+	onEnd(fn func())
+}
+
+// registeredFlowEntry holds what is known about a registered flow for the leaked flow detection.
+type registeredFlowEntry struct {
+	controlPoint string
+	startedAt    time.Time
+	stack        []byte
+	reported     bool
+}
+
+// flowRegistry tracks the flows which have not ended yet, so they can be drained on shutdown and reported if they leak.
+type flowRegistry struct {
+	mu                  sync.Mutex
+	flows               map[registeredFlow]*registeredFlowEntry
+	maxFlows            int
+	fullReported        bool
+	closed              bool
+	drained             chan struct{}
+	leakedFlowThreshold time.Duration
+	log                 *slog.Logger
+	stopLeakDetection   chan struct{}
+}
+
+// newFlowRegistry creates an empty flowRegistry.
+// If leakedFlowThreshold is positive, flows open for longer than it are logged along with the stack they were started from.
+func newFlowRegistry(leakedFlowThreshold time.Duration, logger *slog.Logger) *flowRegistry {
+	r := &flowRegistry{
+		flows:               make(map[registeredFlow]*registeredFlowEntry),
+		maxFlows:            maxRegisteredFlows,
+		drained:             make(chan struct{}),
+		leakedFlowThreshold: leakedFlowThreshold,
+		log:                 logger,
+		stopLeakDetection:   make(chan struct{}),
+	}
+	if leakedFlowThreshold > 0 {
+		go r.detectLeaks()
+	}
+	return r
+}
+
+// add registers a flow. Returns false if the registry is closed.
+// If the registry is full, the flow is not registered, which is logged once until the registry has room again.
+func (r *flowRegistry) add(f registeredFlow, controlPoint string) bool {
+	entry := &registeredFlowEntry{
+		controlPoint: controlPoint,
+		startedAt:    time.Now(),
+	}
+	if r.leakedFlowThreshold > 0 {
+		entry.stack = debug.Stack()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	if len(r.flows) >= r.maxFlows {
+		if !r.fullReported {
+			r.fullReported = true
+			r.log.Warn("Aperture flow registry is full, new flows are not tracked. Flows may be leaking.", "maxFlows", r.maxFlows)
+		}
+		return true
+	}
+	r.fullReported = false
+	r.flows[f] = entry
+	return true
+}
+
+// remove unregisters a flow once it has ended.
+func (r *flowRegistry) remove(f registeredFlow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.flows[f]
+	if !ok {
+		return
+	}
+	delete(r.flows, f)
+	if entry.reported {
+		r.log.Info("Aperture leaked flow ended.", "controlPoint", entry.controlPoint, "duration", time.Since(entry.startedAt))
+	}
+	if r.closed && len(r.flows) == 0 {
+		close(r.drained)
+	}
+}
+
+// close stops registering new flows and the leaked flow detection.
+func (r *flowRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.stopLeakDetection)
+	if len(r.flows) == 0 {
+		close(r.drained)
+	}
+}
+
+// drain waits until all registered flows have ended or ctx is done, for at most timeout if ctx has no deadline.
+// Flows which have not ended by then are ended with the Error status, so that the slots they hold in Aperture Agent are released.
+// A part of the deadline is kept for reporting the end of these flows, so that drain returns by the deadline of ctx.
+// Flows whose Check call is still pending end themselves with the Error status once it returns.
+// Returns the number of flows which had to be ended.
+func (r *flowRegistry) drain(ctx context.Context, timeout time.Duration) int {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	waitCtx, cancel := context.WithDeadline(ctx, deadline.Add(-min(time.Until(deadline)/2, shutdownFlowEndReserve)))
+	defer cancel()
+
+	select {
+	case <-r.drained:
+		return 0
+	case <-waitCtx.Done():
+	}
+
+	r.mu.Lock()
+	leftovers := make([]registeredFlow, 0, len(r.flows))
+	for f := range r.flows {
+		leftovers = append(leftovers, f)
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, f := range leftovers {
+		f := f
+		f.SetStatus(Error)
+		if !f.afterStart(func() { f.End() }) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.endContext(ctx)
+		}()
+	}
+	wg.Wait()
+	return len(leftovers)
+}
+
+// detectLeaks periodically logs the flows open for longer than the leaked flow threshold, once per flow, until the registry is closed.
+func (r *flowRegistry) detectLeaks() {
+	ticker := time.NewTicker(r.leakedFlowThreshold)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopLeakDetection:
+			return
+		case now := <-ticker.C:
+			r.reportLeaks(now)
+		}
+	}
+}
+
+// reportLeaks logs the flows open for longer than the leaked flow threshold which have not been reported yet.
+func (r *flowRegistry) reportLeaks(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.flows {
+		openFor := now.Sub(entry.startedAt)
+		if entry.reported || openFor < r.leakedFlowThreshold {
+			continue
+		}
+		entry.reported = true
+		r.log.Warn("Aperture flow has not ended, it may have leaked.", "controlPoint", entry.controlPoint, "openFor", openFor, "stack", string(entry.stack))
+	}
+}
@@ -0,0 +1,127 @@
+package aperture
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegisteredFlow records how it was ended by the registry.
+type fakeRegisteredFlow struct {
+	mu         sync.Mutex
+	status     FlowStatus
+	ends       int
+	endBounded bool
+	starting   bool
+	onStart    func()
+}
+
+func (f *fakeRegisteredFlow) SetStatus(status FlowStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeRegisteredFlow) End() EndResponse {
+	return f.endContext(context.Background())
+}
+
+func (f *fakeRegisteredFlow) endContext(ctx context.Context) EndResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ends++
+	_, f.endBounded = ctx.Deadline()
+	return EndResponse{}
+}
+
+func (f *fakeRegisteredFlow) afterStart(fn func()) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.starting {
+		f.onStart = fn
+	}
+	return !f.starting
+}
+
+func (f *fakeRegisteredFlow) onEnd(func()) {}
+
+func newTestFlowRegistry(leakedFlowThreshold time.Duration) *flowRegistry {
+	return newFlowRegistry(leakedFlowThreshold, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestFlowRegistryDrainWithoutDeadline(t *testing.T) {
+	r := newTestFlowRegistry(0)
+	f := &fakeRegisteredFlow{}
+	r.add(f, "test")
+	r.close()
+
+	start := time.Now()
+	if ended := r.drain(context.Background(), 10*time.Millisecond); ended != 1 {
+		t.Errorf("drain() = %d, want 1", ended)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain() took %s, want it bounded by the timeout", elapsed)
+	}
+	if f.ends != 1 || f.status != Error {
+		t.Errorf("flow ended %d times with status %s, want once with %s", f.ends, f.status, Error)
+	}
+	if !f.endBounded {
+		t.Errorf("flow end was reported without a deadline, want it bounded by the drain")
+	}
+}
+
+func TestFlowRegistryDrainStartingFlow(t *testing.T) {
+	r := newTestFlowRegistry(0)
+	f := &fakeRegisteredFlow{starting: true}
+	r.add(f, "test")
+	r.close()
+
+	if ended := r.drain(context.Background(), 10*time.Millisecond); ended != 1 {
+		t.Errorf("drain() = %d, want 1", ended)
+	}
+	if f.ends != 0 || f.onStart == nil {
+		t.Fatalf("starting flow ended %d times by drain, want it to end once started", f.ends)
+	}
+	f.onStart()
+	if f.ends != 1 || f.status != Error {
+		t.Errorf("flow ended %d times with status %s, want once with %s", f.ends, f.status, Error)
+	}
+}
+
+func TestFlowRegistryDrainWaitsForFlows(t *testing.T) {
+	r := newTestFlowRegistry(0)
+	f := &fakeRegisteredFlow{}
+	r.add(f, "test")
+	r.close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.remove(f)
+	}()
+	if ended := r.drain(context.Background(), time.Minute); ended != 0 {
+		t.Errorf("drain() = %d, want 0", ended)
+	}
+	if f.ends != 0 {
+		t.Errorf("flow ended %d times by drain, want 0", f.ends)
+	}
+}
+
+func TestFlowRegistryIsBounded(t *testing.T) {
+	r := newTestFlowRegistry(0)
+	r.maxFlows = 2
+	for i := 0; i < 3; i++ {
+		if !r.add(&fakeRegisteredFlow{}, "test") {
+			t.Fatalf("add() = false, want true")
+		}
+	}
+	if got := len(r.flows); got != 2 {
+		t.Errorf("registered flows = %d, want 2", got)
+	}
+	r.close()
+	if r.add(&fakeRegisteredFlow{}, "test") {
+		t.Errorf("add() after close = true, want false")
+	}
+}
@@ -0,0 +1,104 @@
+package aperture
+
+import (
+	"errors"
+	"sync"
+)
+
+// errFlowAlreadyEnded is returned by End when the flow has already ended.
+var errFlowAlreadyEnded = errors.New("flow already ended")
+
+// flowState is the part of flow and httpflow which is safe for concurrent use,
+// e.g. by a worker goroutine setting the status while the request goroutine, context cancellation or client shutdown ends the flow.
+type flowState struct {
+	// starting is done once the client has finished starting the flow, after which the other fields of the flow are not modified.
+	starting     sync.WaitGroup
+	mu           sync.Mutex
+	statusCode   FlowStatus
+	started      bool
+	ended        bool
+	onStartFuncs []func()
+	onEndFuncs   []func()
+}
+
+// initState initializes the state of a flow being started, with the status defaulting to OK.
+func (s *flowState) initState() {
+	s.statusCode = OK
+	s.starting.Add(1)
+}
+
+// markStarted marks the flow as started, letting End proceed, and calls the functions registered with afterStart.
+func (s *flowState) markStarted() {
+	s.mu.Lock()
+	s.started = true
+	onStartFuncs := s.onStartFuncs
+	s.onStartFuncs = nil
+	s.mu.Unlock()
+	s.starting.Done()
+
+	for _, fn := range onStartFuncs {
+		fn()
+	}
+}
+
+// afterStart reports whether the flow has been started.
+// If it has not, fn is registered to be called once it is, so that e.g. the shutdown drain does not wait for a pending Check call.
+func (s *flowState) afterStart(fn func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return true
+	}
+	s.onStartFuncs = append(s.onStartFuncs, fn)
+	return false
+}
+
+// setStatus sets the status code of the flow.
+func (s *flowState) setStatus(statusCode FlowStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = statusCode
+}
+
+// onEnd registers fn to be called once the flow ends, or calls it right away if the flow has already ended. A nil fn is ignored.
+func (s *flowState) onEnd(fn func()) {
+	if fn == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		fn()
+		return
+	}
+	s.onEndFuncs = append(s.onEndFuncs, fn)
+	s.mu.Unlock()
+}
+
+// end marks the flow as ended once it has been started.
+// Returns the status code of the flow, or errFlowAlreadyEnded if the flow has already ended.
+// Once the flow has been reported to Aperture Agent, the caller must call runOnEnd.
+func (s *flowState) end() (FlowStatus, error) {
+	s.starting.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return 0, errFlowAlreadyEnded
+	}
+	s.ended = true
+	return s.statusCode, nil
+}
+
+// runOnEnd calls the functions registered with onEnd, once the flow has ended.
+// It runs after the flow end is reported, so that e.g. the shutdown drain does not close the connection while the report is in flight.
+func (s *flowState) runOnEnd() {
+	s.mu.Lock()
+	onEndFuncs := s.onEndFuncs
+	s.onEndFuncs = nil
+	s.mu.Unlock()
+
+	for _, fn := range onEndFuncs {
+		fn()
+	}
+}
@@ -23,6 +23,10 @@ var (
 
 	// ErrKeyMissingFromGlobalCacheResponse is returned when the global cache response does not contain the key.
 	ErrKeyMissingFromGlobalCacheResponse = errors.New("key missing from global cache response")
+
+	// ErrCheckTimeout is returned by Flow.Error() when the Check call did not complete within the timeout.
+	// It is not returned when the context passed by the caller is done first, e.g. because of its own deadline.
+	ErrCheckTimeout = errors.New("check call timed out")
 )
 
 // CacheEntry describes the properties of cache entry.
@@ -57,19 +61,29 @@ type Flow interface {
 	CheckResponse() *checkv1.CheckResponse
 	RetryAfter() time.Duration
 	HTTPResponseCode() int
+	DecisionSource() DecisionSource
+	RejectionError() *RejectionError
+	Attempts() int
 }
 
 type flow struct {
 	flowControlClient checkv1.FlowControlServiceClient
 	span              trace.Span
+	callerSpan        trace.Span
 	err               error
 	checkResponse     *checkv1.CheckResponse
 	resultCacheKey    string
 	globalCacheKeys   []string
-	statusCode        FlowStatus
-	ended             bool
-	rampMode          bool
 	callOptions       []grpc.CallOption
+	decisionSource    DecisionSource
+	failureAccepted   bool
+	controlPoint      string
+	workloadStart     time.Time
+	metrics           *metrics
+	localCache        *localCache
+	globalCache       *globalCache
+	attempts          int
+	flowState
 }
 
 // flow implements the Flow interface.
@@ -79,28 +93,54 @@ var _ Flow = (*flow)(nil)
 func newFlow(
 	flowControlClient checkv1.FlowControlServiceClient,
 	span trace.Span,
-	rampMode bool,
+	controlPoint string,
 	resultCacheKey string,
 	globalCacheKeys []string,
 	callOptions []grpc.CallOption,
+	metrics *metrics,
+	localCache *localCache,
 ) *flow {
-	return &flow{
+	f := &flow{
 		flowControlClient: flowControlClient,
+		controlPoint:      controlPoint,
+		metrics:           metrics,
 		span:              span,
 		checkResponse:     nil,
-		statusCode:        OK,
-		ended:             false,
-		rampMode:          rampMode,
 		resultCacheKey:    resultCacheKey,
 		globalCacheKeys:   globalCacheKeys,
 		callOptions:       callOptions,
+		localCache:        localCache,
+		globalCache:       newGlobalCache(flowControlClient, localCache),
 	}
+	f.initState()
+	return f
 }
 
 // ShouldRun returns whether the Flow was allowed to run by Aperture Agent.
-// By default, fail-open behavior is enabled. Set rampMode to disable it.
+// If the Check call failed, the decision is made by the FailureMode of the flow.
 func (f *flow) ShouldRun() bool {
-	return (!f.rampMode && f.checkResponse == nil) || (f.checkResponse.DecisionType == checkv1.CheckResponse_DECISION_TYPE_ACCEPTED)
+	if f.checkResponse == nil {
+		return f.failureAccepted
+	}
+	return f.checkResponse.DecisionType == checkv1.CheckResponse_DECISION_TYPE_ACCEPTED
+}
+
+// DecisionSource returns which path made the decision whether the flow should run.
+func (f *flow) DecisionSource() DecisionSource {
+	return f.decisionSource
+}
+
+// RejectionError describes why the flow was not allowed to run. Returns nil if the flow should run.
+func (f *flow) RejectionError() *RejectionError {
+	if f.ShouldRun() {
+		return nil
+	}
+	return newRejectionError(f.controlPoint, f.decisionSource, f.checkResponse, f.err)
+}
+
+// Attempts returns the number of Check calls made to start the flow, including the retries of the rejected attempts.
+func (f *flow) Attempts() int {
+	return f.attempts
 }
 
 // CheckResponse returns the response from the server.
@@ -128,11 +168,19 @@ func (f *flow) HTTPResponseCode() int {
 // SetStatus sets the status code of a flow.
 // If not set explicitly, defaults to FlowStatus.OK.
 func (f *flow) SetStatus(statusCode FlowStatus) {
-	f.statusCode = statusCode
+	f.setStatus(statusCode)
 }
 
 // ResultCache returns the cached value for the flow.
+// The local cache, if enabled, is consulted before the result cache lookup served by Aperture Agent.
 func (f *flow) ResultCache() KeyLookupResponse {
+	// The local cache is consulted first, so that it keeps serving the flows admitted while the Check call fails.
+	localKey := resultLocalCacheKey(f.controlPoint, f.resultCacheKey)
+	if f.resultCacheKey != "" && f.ShouldRun() {
+		if value, ok := f.localCache.get(localKey); ok {
+			return newKeyLookupResponse(value, LookupStatusHit, nil)
+		}
+	}
 	if f.err != nil {
 		return newKeyLookupResponse(nil, LookupStatusMiss, f.err)
 	}
@@ -147,10 +195,15 @@ func (f *flow) ResultCache() KeyLookupResponse {
 	}
 	lookupResponse := f.checkResponse.CacheLookupResponse.GetResultCacheResponse()
 
-	return newKeyLookupResponse(lookupResponse.Value, convertCacheLookupStatus(lookupResponse.LookupStatus), convertCacheError(lookupResponse.Error))
+	response := newKeyLookupResponse(lookupResponse.Value, convertCacheLookupStatus(lookupResponse.LookupStatus), convertCacheError(lookupResponse.Error))
+	if f.resultCacheKey != "" && response.Error() == nil && response.LookupStatus() == LookupStatusHit {
+		f.localCache.setLookup(localKey, response.Value())
+	}
+	return response
 }
 
 // SetResultCache sets the result cache entry for the flow.
+// Once Aperture Agent has stored it, the entry is written through to the local cache, if enabled.
 func (f *flow) SetResultCache(ctx context.Context, cacheEntry CacheEntry, opts ...grpc.CallOption) KeyUpsertResponse {
 	if f.resultCacheKey == "" {
 		return newKeyUpsertResponse(ErrResultCacheKeyNotSet)
@@ -178,14 +231,20 @@ func (f *flow) SetResultCache(ctx context.Context, cacheEntry CacheEntry, opts .
 		return newKeyUpsertResponse(ErrResultCacheResponseNil)
 	}
 
-	return newKeyUpsertResponse(convertCacheError(cacheUpsertResponse.ResultCacheResponse.GetError()))
+	upsertErr := convertCacheError(cacheUpsertResponse.ResultCacheResponse.GetError())
+	if upsertErr == nil {
+		f.localCache.set(resultLocalCacheKey(f.controlPoint, f.resultCacheKey), cacheEntry.Value, cacheEntry.TTL)
+	}
+	return newKeyUpsertResponse(upsertErr)
 }
 
 // DeleteResultCache deletes the result cache entry for the flow.
+// The entry is invalidated in the local cache, if enabled, even if the deletion in Aperture Agent fails.
 func (f *flow) DeleteResultCache(ctx context.Context, opts ...grpc.CallOption) KeyDeleteResponse {
 	if f.resultCacheKey == "" {
 		return newKeyDeleteResponse(ErrResultCacheKeyNotSet)
 	}
+	f.localCache.delete(resultLocalCacheKey(f.controlPoint, f.resultCacheKey))
 
 	if f.checkResponse == nil {
 		return newKeyDeleteResponse(f.err)
@@ -206,7 +265,16 @@ func (f *flow) DeleteResultCache(ctx context.Context, opts ...grpc.CallOption) K
 }
 
 // GlobalCache returns a global cache entry for the flow.
+// The local cache, if enabled, is consulted before the global cache lookups served by Aperture Agent,
+// so hot keys cached locally need not be listed in FlowParams.GlobalCacheKeys.
 func (f *flow) GlobalCache(key string) KeyLookupResponse {
+	// The local cache is consulted first, so that it keeps serving the flows admitted while the Check call fails.
+	localKey := globalLocalCacheKey(key)
+	if f.ShouldRun() {
+		if value, ok := f.localCache.get(localKey); ok {
+			return newKeyLookupResponse(value, LookupStatusHit, nil)
+		}
+	}
 	if f.err != nil {
 		return newKeyLookupResponse(nil, LookupStatusMiss, f.err)
 	}
@@ -225,50 +293,23 @@ func (f *flow) GlobalCache(key string) KeyLookupResponse {
 		return newKeyLookupResponse(nil, LookupStatusMiss, errors.New("unknown global cache key"))
 	}
 
-	return newKeyLookupResponse(lookupResponse.Value, convertCacheLookupStatus(lookupResponse.LookupStatus), convertCacheError(lookupResponse.Error))
+	response := newKeyLookupResponse(lookupResponse.Value, convertCacheLookupStatus(lookupResponse.LookupStatus), convertCacheError(lookupResponse.Error))
+	if response.Error() == nil && response.LookupStatus() == LookupStatusHit {
+		f.localCache.setLookup(localKey, response.Value())
+	}
+	return response
 }
 
 // SetGlobalCache sets a global cache entry for the flow.
+// Once Aperture Agent has stored it, the entry is written through to the local cache, if enabled.
 func (f *flow) SetGlobalCache(ctx context.Context, key string, cacheEntry CacheEntry, opts ...grpc.CallOption) KeyUpsertResponse {
-	ttlProto := durationpb.New(cacheEntry.TTL)
-
-	cacheUpsertResponse, err := f.flowControlClient.CacheUpsert(ctx, &checkv1.CacheUpsertRequest{
-		GlobalCacheEntries: map[string]*checkv1.CacheEntry{
-			key: {
-				Value: cacheEntry.Value,
-				Ttl:   ttlProto,
-			},
-		},
-	}, opts...)
-	if err != nil {
-		return newKeyUpsertResponse(err)
-	}
-
-	upsertResponse, ok := cacheUpsertResponse.GlobalCacheResponses[key]
-	if !ok {
-		return newKeyUpsertResponse(ErrKeyMissingFromGlobalCacheResponse)
-	}
-
-	return newKeyUpsertResponse(convertCacheError(upsertResponse.Error))
+	return f.globalCache.set(ctx, map[string]CacheEntry{key: cacheEntry}, opts...)[key]
 }
 
 // DeleteGlobalCache deletes a global cache entry for the flow.
+// The entry is invalidated in the local cache, if enabled, even if the deletion in Aperture Agent fails.
 func (f *flow) DeleteGlobalCache(ctx context.Context, key string, opts ...grpc.CallOption) KeyDeleteResponse {
-	cacheDeleteResponse, err := f.flowControlClient.CacheDelete(ctx, &checkv1.CacheDeleteRequest{
-		GlobalCacheKeys: []string{
-			key,
-		},
-	}, opts...)
-	if err != nil {
-		return newKeyDeleteResponse(err)
-	}
-
-	deleteResponse, ok := cacheDeleteResponse.GlobalCacheResponses[key]
-	if !ok {
-		return newKeyDeleteResponse(ErrKeyMissingFromGlobalCacheResponse)
-	}
-
-	return newKeyDeleteResponse(convertCacheError(deleteResponse.Error))
+	return f.globalCache.delete(ctx, []string{key}, opts...)[key]
 }
 
 // Error returns the error that occurred during the flow.
@@ -281,13 +322,31 @@ func (f *flow) Span() trace.Span {
 	return f.span
 }
 
+// contextSpan returns the span under which the downstream work of the flow is nested, see ContextWithFlowSpan.
+func (f *flow) contextSpan() trace.Span {
+	if f.callerSpan != nil {
+		return f.callerSpan
+	}
+	return f.span
+}
+
 // End is used to end the flow, using the status code previously set using SetStatus method.
 func (f *flow) End() EndResponse {
-	if f.ended {
+	return f.endContext(context.Background())
+}
+
+// endContext ends the flow, reporting its end to Aperture Agent within ctx.
+func (f *flow) endContext(ctx context.Context) EndResponse {
+	statusCode, err := f.end()
+	if err != nil {
 		return EndResponse{
-			Error: errors.New("flow already ended"),
+			Error: err,
 		}
 	}
+	defer f.runOnEnd()
+	defer endCallerSpan(f.callerSpan, statusCode)
+
+	f.metrics.recordEnd(context.Background(), f.controlPoint, statusCode, time.Since(f.workloadStart))
 
 	if f.checkResponse == nil {
 		return EndResponse{
@@ -295,8 +354,6 @@ func (f *flow) End() EndResponse {
 		}
 	}
 
-	f.ended = true
-
 	checkResponseJSONBytes, err := protojson.Marshal(f.checkResponse)
 	if err != nil {
 		return EndResponse{
@@ -304,7 +361,7 @@ func (f *flow) End() EndResponse {
 		}
 	}
 	f.span.SetAttributes(
-		attribute.String(flowStatusLabel, f.statusCode.String()),
+		attribute.String(flowStatusLabel, statusCode.String()),
 		attribute.String(checkResponseLabel, string(checkResponseJSONBytes)),
 		attribute.Int64(flowEndTimestampLabel, time.Now().UnixNano()),
 	)
@@ -352,11 +409,15 @@ func (f *flow) End() EndResponse {
 		return EndResponse{}
 	}
 
-	flowEndResponse, err := f.flowControlClient.FlowEnd(context.Background(), &checkv1.FlowEndRequest{
+	flowEndResponse, err := f.flowControlClient.FlowEnd(ctx, &checkv1.FlowEndRequest{
 		ControlPoint:     f.checkResponse.ControlPoint,
 		InflightRequests: inflightRequests,
 	}, f.callOptions...)
 
+	if err != nil {
+		f.metrics.recordFlowEndError(context.Background(), f.controlPoint)
+	}
+
 	return EndResponse{
 		FlowEndResponse: flowEndResponse,
 		Error:           err,
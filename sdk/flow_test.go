@@ -0,0 +1,227 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// fakeFlowControlClient answers the cache calls with empty results and counts the FlowEnd calls.
+type fakeFlowControlClient struct {
+	flowEnds atomic.Int32
+}
+
+func (c *fakeFlowControlClient) Check(ctx context.Context, in *checkv1.CheckRequest, opts ...grpc.CallOption) (*checkv1.CheckResponse, error) {
+	return &checkv1.CheckResponse{}, nil
+}
+
+func (c *fakeFlowControlClient) CacheLookup(ctx context.Context, in *checkv1.CacheLookupRequest, opts ...grpc.CallOption) (*checkv1.CacheLookupResponse, error) {
+	return &checkv1.CacheLookupResponse{}, nil
+}
+
+func (c *fakeFlowControlClient) CacheUpsert(ctx context.Context, in *checkv1.CacheUpsertRequest, opts ...grpc.CallOption) (*checkv1.CacheUpsertResponse, error) {
+	res := &checkv1.CacheUpsertResponse{
+		ResultCacheResponse:  &checkv1.KeyUpsertResponse{},
+		GlobalCacheResponses: map[string]*checkv1.KeyUpsertResponse{},
+	}
+	for key := range in.GetGlobalCacheEntries() {
+		res.GlobalCacheResponses[key] = &checkv1.KeyUpsertResponse{}
+	}
+	return res, nil
+}
+
+func (c *fakeFlowControlClient) CacheDelete(ctx context.Context, in *checkv1.CacheDeleteRequest, opts ...grpc.CallOption) (*checkv1.CacheDeleteResponse, error) {
+	res := &checkv1.CacheDeleteResponse{
+		ResultCacheResponse:  &checkv1.KeyDeleteResponse{},
+		GlobalCacheResponses: map[string]*checkv1.KeyDeleteResponse{},
+	}
+	for _, key := range in.GetGlobalCacheKeys() {
+		res.GlobalCacheResponses[key] = &checkv1.KeyDeleteResponse{}
+	}
+	return res, nil
+}
+
+func (c *fakeFlowControlClient) FlowEnd(ctx context.Context, in *checkv1.FlowEndRequest, opts ...grpc.CallOption) (*checkv1.FlowEndResponse, error) {
+	c.flowEnds.Add(1)
+	return &checkv1.FlowEndResponse{}, nil
+}
+
+func newTestMetrics(t *testing.T) *metrics {
+	t.Helper()
+	m, err := newMetrics(noop.NewMeterProvider())
+	if err != nil {
+		t.Fatalf("newMetrics() error = %v", err)
+	}
+	return m
+}
+
+func newTestTracerProvider() *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider()
+}
+
+// acceptedCheckResponse returns a Check response holding a concurrency limiter slot, which has to be released by FlowEnd.
+func acceptedCheckResponse() *checkv1.CheckResponse {
+	return &checkv1.CheckResponse{
+		ControlPoint: "test",
+		DecisionType: checkv1.CheckResponse_DECISION_TYPE_ACCEPTED,
+		LimiterDecisions: []*checkv1.LimiterDecision{
+			{
+				PolicyName:  "policy",
+				ComponentId: "1",
+				Details: &checkv1.LimiterDecision_ConcurrencyLimiterInfo_{
+					ConcurrencyLimiterInfo: &checkv1.LimiterDecision_ConcurrencyLimiterInfo{
+						RequestId: "request",
+					},
+				},
+			},
+		},
+	}
+}
+
+// endConcurrently calls End from several goroutines while others set the status and returns the number of End calls that succeeded.
+func endConcurrently(end func() EndResponse, setStatus func(FlowStatus), other func()) int32 {
+	var succeeded atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if end().Error == nil {
+				succeeded.Add(1)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			setStatus(FlowStatus(i % 2))
+		}(i)
+		go func() {
+			defer wg.Done()
+			other()
+		}()
+	}
+	wg.Wait()
+	return succeeded.Load()
+}
+
+func TestFlowConcurrentEnd(t *testing.T) {
+	tp := newTestTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	fcClient := &fakeFlowControlClient{}
+	_, span := tp.Tracer(libraryName).Start(context.Background(), "test")
+	f := newFlow(fcClient, span, "test", "result", []string{"global"}, nil, newTestMetrics(t), nil)
+	f.checkResponse = acceptedCheckResponse()
+	var onEndCalls atomic.Int32
+	f.onEnd(func() { onEndCalls.Add(1) })
+	f.markStarted()
+
+	ctx := context.Background()
+	succeeded := endConcurrently(f.End, f.SetStatus, func() {
+		f.ShouldRun()
+		f.ResultCache()
+		f.GlobalCache("global")
+		f.SetResultCache(ctx, CacheEntry{Value: []byte("value"), TTL: time.Second})
+		f.SetGlobalCache(ctx, "global", CacheEntry{Value: []byte("value"), TTL: time.Second})
+		f.DeleteResultCache(ctx)
+		f.DeleteGlobalCache(ctx, "global")
+	})
+
+	if succeeded != 1 {
+		t.Errorf("successful End calls = %d, want 1", succeeded)
+	}
+	if got := fcClient.flowEnds.Load(); got != 1 {
+		t.Errorf("FlowEnd calls = %d, want 1", got)
+	}
+	if got := onEndCalls.Load(); got != 1 {
+		t.Errorf("onEnd calls = %d, want 1", got)
+	}
+}
+
+func TestHTTPFlowConcurrentEnd(t *testing.T) {
+	tp := newTestTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	fcClient := &fakeFlowControlClient{}
+	_, span := tp.Tracer(libraryName).Start(context.Background(), "test")
+	f := newHTTPFlow(span, "test", FlowParams{}, fcClient, newTestMetrics(t))
+	f.checkResponse = &checkhttpv1.CheckHTTPResponse{
+		Status:        &status.Status{Code: int32(code.Code_OK)},
+		CheckResponse: acceptedCheckResponse(),
+	}
+	var onEndCalls atomic.Int32
+	f.onEnd(func() { onEndCalls.Add(1) })
+	f.markStarted()
+
+	succeeded := endConcurrently(f.End, f.SetStatus, func() {
+		f.ShouldRun()
+		f.CheckResponse()
+		f.DecisionSource()
+	})
+
+	if succeeded != 1 {
+		t.Errorf("successful End calls = %d, want 1", succeeded)
+	}
+	if got := fcClient.flowEnds.Load(); got != 1 {
+		t.Errorf("FlowEnd calls = %d, want 1", got)
+	}
+	if got := onEndCalls.Load(); got != 1 {
+		t.Errorf("onEnd calls = %d, want 1", got)
+	}
+}
+
+func TestFlowEndWaitsForStart(t *testing.T) {
+	tp := newTestTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer(libraryName).Start(context.Background(), "test")
+	f := newFlow(&fakeFlowControlClient{}, span, "test", "", nil, nil, newTestMetrics(t), nil)
+
+	ended := make(chan EndResponse)
+	go func() {
+		ended <- f.End()
+	}()
+
+	select {
+	case <-ended:
+		t.Fatal("End returned before the flow was started")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Written before markStarted, the same way the client does.
+	f.checkResponse = acceptedCheckResponse()
+	f.markStarted()
+
+	if res := <-ended; res.Error != nil {
+		t.Errorf("End() error = %v", res.Error)
+	}
+}
+
+func TestFlowOnEndAfterEnd(t *testing.T) {
+	tp := newTestTracerProvider()
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer(libraryName).Start(context.Background(), "test")
+	f := newFlow(&fakeFlowControlClient{}, span, "test", "", nil, nil, newTestMetrics(t), nil)
+	f.markStarted()
+	f.End()
+
+	called := false
+	f.onEnd(func() { called = true })
+	if !called {
+		t.Error("onEnd registered after End was not called")
+	}
+	if res := f.End(); res.Error != errFlowAlreadyEnded {
+		t.Errorf("second End() error = %v, want %v", res.Error, errFlowAlreadyEnded)
+	}
+}
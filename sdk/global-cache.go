@@ -0,0 +1,153 @@
+package aperture
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+)
+
+// GlobalCache is the global cache of Aperture Agent, shared by all control points, which can be used without starting a flow.
+// Each call batches its keys into a single request and returns the response of every key.
+// If the request fails, every key gets its error. The call options are passed to the request.
+type GlobalCache interface {
+	Get(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyLookupResponse
+	Set(ctx context.Context, entries map[string]CacheEntry, opts ...grpc.CallOption) map[string]KeyUpsertResponse
+	Delete(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyDeleteResponse
+}
+
+type globalCache struct {
+	flowControlClient checkv1.FlowControlServiceClient
+	localCache        *localCache
+}
+
+// globalCache implements the GlobalCache interface.
+var _ GlobalCache = (*globalCache)(nil)
+
+// newGlobalCache creates a new global cache in front of which sits localCache, if enabled.
+func newGlobalCache(flowControlClient checkv1.FlowControlServiceClient, localCache *localCache) *globalCache {
+	return &globalCache{
+		flowControlClient: flowControlClient,
+		localCache:        localCache,
+	}
+}
+
+// Get looks up global cache entries. The keys found in the local cache, if enabled, are not looked up in Aperture Agent.
+func (gc *globalCache) Get(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyLookupResponse {
+	return gc.get(ctx, keys, opts...)
+}
+
+// Set upserts global cache entries. The stored entries are written through to the local cache, if enabled.
+func (gc *globalCache) Set(ctx context.Context, entries map[string]CacheEntry, opts ...grpc.CallOption) map[string]KeyUpsertResponse {
+	return gc.set(ctx, entries, opts...)
+}
+
+// Delete deletes global cache entries. The entries are invalidated in the local cache, if enabled, even if the deletion fails.
+func (gc *globalCache) Delete(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyDeleteResponse {
+	return gc.delete(ctx, keys, opts...)
+}
+
+func (gc *globalCache) get(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyLookupResponse {
+	responses := make(map[string]KeyLookupResponse, len(keys))
+	var lookupKeys []string
+	for _, key := range keys {
+		if _, ok := responses[key]; ok {
+			continue
+		}
+		if value, ok := gc.localCache.get(globalLocalCacheKey(key)); ok {
+			responses[key] = newKeyLookupResponse(value, LookupStatusHit, nil)
+			continue
+		}
+		// Reserve the key so that duplicates are looked up once.
+		responses[key] = nil
+		lookupKeys = append(lookupKeys, key)
+	}
+	if len(lookupKeys) == 0 {
+		return responses
+	}
+
+	cacheLookupResponse, err := gc.flowControlClient.CacheLookup(ctx, &checkv1.CacheLookupRequest{
+		GlobalCacheKeys: lookupKeys,
+	}, opts...)
+	for _, key := range lookupKeys {
+		if err != nil {
+			responses[key] = newKeyLookupResponse(nil, LookupStatusMiss, err)
+			continue
+		}
+		lookupResponse, ok := cacheLookupResponse.GetGlobalCacheResponses()[key]
+		if !ok {
+			responses[key] = newKeyLookupResponse(nil, LookupStatusMiss, ErrKeyMissingFromGlobalCacheResponse)
+			continue
+		}
+		response := newKeyLookupResponse(lookupResponse.Value, convertCacheLookupStatus(lookupResponse.LookupStatus), convertCacheError(lookupResponse.Error))
+		if response.Error() == nil && response.LookupStatus() == LookupStatusHit {
+			gc.localCache.setLookup(globalLocalCacheKey(key), response.Value())
+		}
+		responses[key] = response
+	}
+	return responses
+}
+
+func (gc *globalCache) set(ctx context.Context, entries map[string]CacheEntry, opts ...grpc.CallOption) map[string]KeyUpsertResponse {
+	responses := make(map[string]KeyUpsertResponse, len(entries))
+	if len(entries) == 0 {
+		return responses
+	}
+
+	cacheEntries := make(map[string]*checkv1.CacheEntry, len(entries))
+	for key, entry := range entries {
+		cacheEntries[key] = &checkv1.CacheEntry{
+			Value: entry.Value,
+			Ttl:   durationpb.New(entry.TTL),
+		}
+	}
+	cacheUpsertResponse, err := gc.flowControlClient.CacheUpsert(ctx, &checkv1.CacheUpsertRequest{
+		GlobalCacheEntries: cacheEntries,
+	}, opts...)
+	for key, entry := range entries {
+		if err != nil {
+			responses[key] = newKeyUpsertResponse(err)
+			continue
+		}
+		upsertResponse, ok := cacheUpsertResponse.GetGlobalCacheResponses()[key]
+		if !ok {
+			responses[key] = newKeyUpsertResponse(ErrKeyMissingFromGlobalCacheResponse)
+			continue
+		}
+		upsertErr := convertCacheError(upsertResponse.Error)
+		if upsertErr == nil {
+			gc.localCache.set(globalLocalCacheKey(key), entry.Value, entry.TTL)
+		}
+		responses[key] = newKeyUpsertResponse(upsertErr)
+	}
+	return responses
+}
+
+func (gc *globalCache) delete(ctx context.Context, keys []string, opts ...grpc.CallOption) map[string]KeyDeleteResponse {
+	responses := make(map[string]KeyDeleteResponse, len(keys))
+	if len(keys) == 0 {
+		return responses
+	}
+
+	for _, key := range keys {
+		gc.localCache.delete(globalLocalCacheKey(key))
+	}
+	cacheDeleteResponse, err := gc.flowControlClient.CacheDelete(ctx, &checkv1.CacheDeleteRequest{
+		GlobalCacheKeys: keys,
+	}, opts...)
+	for _, key := range keys {
+		if err != nil {
+			responses[key] = newKeyDeleteResponse(err)
+			continue
+		}
+		deleteResponse, ok := cacheDeleteResponse.GetGlobalCacheResponses()[key]
+		if !ok {
+			responses[key] = newKeyDeleteResponse(ErrKeyMissingFromGlobalCacheResponse)
+			continue
+		}
+		responses[key] = newKeyDeleteResponse(convertCacheError(deleteResponse.Error))
+	}
+	return responses
+}
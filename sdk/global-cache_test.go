@@ -0,0 +1,102 @@
+package aperture_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestGlobalCache(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	globalCache := client.GlobalCache()
+	ctx := context.Background()
+
+	upserts := globalCache.Set(ctx, map[string]aperture.CacheEntry{
+		"a": {Value: []byte("a"), TTL: time.Minute},
+		"b": {Value: []byte("b"), TTL: time.Minute},
+	})
+	for _, key := range []string{"a", "b"} {
+		if res, ok := upserts[key]; !ok || res.Error() != nil {
+			t.Errorf("Set() response of %s = %v, want a success", key, res)
+		}
+	}
+	if requests := agent.CacheUpsertRequests(); len(requests) != 1 || len(requests[0].GetGlobalCacheEntries()) != 2 {
+		t.Errorf("CacheUpsert requests = %v, want a single request with both entries", requests)
+	}
+
+	lookups := globalCache.Get(ctx, []string{"a", "b", "missing", "a"})
+	if len(lookups) != 3 {
+		t.Fatalf("Get() responses = %d, want one per distinct key", len(lookups))
+	}
+	for _, key := range []string{"a", "b"} {
+		if res := lookups[key]; res.LookupStatus() != aperture.LookupStatusHit || string(res.Value()) != key {
+			t.Errorf("Get() response of %s = %q, %s, want the hit", key, res.Value(), res.LookupStatus())
+		}
+	}
+	if res := lookups["missing"]; res.LookupStatus() != aperture.LookupStatusMiss {
+		t.Errorf("Get() response of missing = %s, want a miss", res.LookupStatus())
+	}
+
+	deletes := globalCache.Delete(ctx, []string{"a", "b"})
+	for _, key := range []string{"a", "b"} {
+		if res, ok := deletes[key]; !ok || res.Error() != nil {
+			t.Errorf("Delete() response of %s = %v, want a success", key, res)
+		}
+	}
+	if requests := agent.CacheDeleteRequests(); len(requests) != 1 || len(requests[0].GetGlobalCacheKeys()) != 2 {
+		t.Errorf("CacheDelete requests = %v, want a single request with both keys", requests)
+	}
+	if res := globalCache.Get(ctx, []string{"a"})["a"]; res.LookupStatus() != aperture.LookupStatusMiss {
+		t.Errorf("Get() after Delete() = %s, want a miss", res.LookupStatus())
+	}
+}
+
+func TestGlobalCacheLocalCache(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{
+		LocalCache: aperture.LocalCacheOptions{MaxEntries: 10},
+	})
+	globalCache := client.GlobalCache()
+	ctx := context.Background()
+
+	globalCache.Set(ctx, map[string]aperture.CacheEntry{"a": {Value: []byte("a"), TTL: time.Minute}})
+	// Entries written through are served locally, even once gone from Aperture Agent.
+	agent.Reset()
+	if res := globalCache.Get(ctx, []string{"a"})["a"]; res.LookupStatus() != aperture.LookupStatusHit || string(res.Value()) != "a" {
+		t.Errorf("Get() = %q, %s, want the local hit", res.Value(), res.LookupStatus())
+	}
+	if got := client.LocalCacheStats().Hits; got != 1 {
+		t.Errorf("local cache hits = %d, want 1", got)
+	}
+
+	globalCache.Delete(ctx, []string{"a"})
+	if res := globalCache.Get(ctx, []string{"a"})["a"]; res.LookupStatus() != aperture.LookupStatusMiss {
+		t.Errorf("Get() after Delete() = %s, want a miss", res.LookupStatus())
+	}
+}
+
+func TestGlobalCacheCallOptions(t *testing.T) {
+	client, _ := aperturetest.NewTestClient(t, aperture.Options{})
+	globalCache := client.GlobalCache()
+	ctx := context.Background()
+
+	for name, call := range map[string]func(opt grpc.CallOption){
+		"Get": func(opt grpc.CallOption) { globalCache.Get(ctx, []string{"a"}, opt) },
+		"Set": func(opt grpc.CallOption) {
+			globalCache.Set(ctx, map[string]aperture.CacheEntry{"a": {TTL: time.Minute}}, opt)
+		},
+		"Delete": func(opt grpc.CallOption) { globalCache.Delete(ctx, []string{"a"}, opt) },
+	} {
+		// The peer is filled in only if the call option reaches the request.
+		var p peer.Peer
+		call(grpc.Peer(&p))
+		if p.Addr == nil {
+			t.Errorf("%s() did not pass its call options to the request", name)
+		}
+	}
+}
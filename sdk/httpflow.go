@@ -24,39 +24,47 @@ type HTTPFlow interface {
 	Span() trace.Span
 	End() EndResponse
 	CheckResponse() *checkhttpv1.CheckHTTPResponse
+	DecisionSource() DecisionSource
+	RejectionError() *RejectionError
 }
 
 type httpflow struct {
 	span              trace.Span
+	callerSpan        trace.Span
 	err               error
 	checkResponse     *checkhttpv1.CheckHTTPResponse
 	flowParams        FlowParams
-	statusCode        FlowStatus
-	ended             bool
 	flowControlClient checkv1.FlowControlServiceClient
+	decisionSource    DecisionSource
+	failureAccepted   bool
+	controlPoint      string
+	workloadStart     time.Time
+	metrics           *metrics
+	flowState
 }
 
 // newFlow creates a new flow with default field values.
-func newHTTPFlow(span trace.Span, flowParams FlowParams, flowControlClient checkv1.FlowControlServiceClient) *httpflow {
-	return &httpflow{
+func newHTTPFlow(span trace.Span, controlPoint string, flowParams FlowParams, flowControlClient checkv1.FlowControlServiceClient, metrics *metrics) *httpflow {
+	f := &httpflow{
+		controlPoint:      controlPoint,
+		metrics:           metrics,
 		span:              span,
 		checkResponse:     nil,
-		statusCode:        OK,
-		ended:             false,
 		flowParams:        flowParams,
 		err:               nil,
 		flowControlClient: flowControlClient,
 	}
+	f.initState()
+	return f
 }
 
 // ShouldRun returns whether the Flow was allowed to run by Aperture Agent.
-// By default, fail-open behavior is enabled. Set rampMode to disable it.
+// If the CheckHTTP call failed, the decision is made by the FailureMode of the flow.
 func (f *httpflow) ShouldRun() bool {
-	if (!f.flowParams.RampMode && f.checkResponse == nil) || (f.checkResponse.Status.Code == int32(code.Code_OK)) {
-		return true
-	} else {
-		return false
+	if f.checkResponse == nil {
+		return f.failureAccepted
 	}
+	return f.checkResponse.GetStatus().GetCode() == int32(code.Code_OK)
 }
 
 // CheckResponse returns the response from the server.
@@ -64,10 +72,28 @@ func (f *httpflow) CheckResponse() *checkhttpv1.CheckHTTPResponse {
 	return f.checkResponse
 }
 
+// DecisionSource returns which path made the decision whether the flow should run.
+func (f *httpflow) DecisionSource() DecisionSource {
+	return f.decisionSource
+}
+
+// RejectionError describes why the flow was not allowed to run. Returns nil if the flow should run.
+// The HTTP status code is the one of the denied response, if any.
+func (f *httpflow) RejectionError() *RejectionError {
+	if f.ShouldRun() {
+		return nil
+	}
+	rejection := newRejectionError(f.controlPoint, f.decisionSource, f.checkResponse.GetCheckResponse(), f.err)
+	if statusCode := f.checkResponse.GetDeniedResponse().GetStatus(); statusCode != 0 {
+		rejection.HTTPStatusCode = int(statusCode)
+	}
+	return rejection
+}
+
 // SetStatus sets the status code of a flow.
 // If not set explicitly, defaults to FlowStatus.OK.
 func (f *httpflow) SetStatus(statusCode FlowStatus) {
-	f.statusCode = statusCode
+	f.setStatus(statusCode)
 }
 
 // Error returns the error that occurred during the flow.
@@ -80,13 +106,31 @@ func (f *httpflow) Span() trace.Span {
 	return f.span
 }
 
+// contextSpan returns the span under which the downstream work of the flow is nested, see ContextWithFlowSpan.
+func (f *httpflow) contextSpan() trace.Span {
+	if f.callerSpan != nil {
+		return f.callerSpan
+	}
+	return f.span
+}
+
 // End is used to end the flow, using the status code previously set using SetStatus method.
 func (f *httpflow) End() EndResponse {
-	if f.ended {
+	return f.endContext(context.Background())
+}
+
+// endContext ends the flow, reporting its end to Aperture Agent within ctx.
+func (f *httpflow) endContext(ctx context.Context) EndResponse {
+	statusCode, err := f.end()
+	if err != nil {
 		return EndResponse{
-			Error: errors.New("flow already ended"),
+			Error: err,
 		}
 	}
+	defer f.runOnEnd()
+	defer endCallerSpan(f.callerSpan, statusCode)
+
+	f.metrics.recordEnd(context.Background(), f.controlPoint, statusCode, time.Since(f.workloadStart))
 
 	if f.checkResponse == nil {
 		return EndResponse{
@@ -94,8 +138,6 @@ func (f *httpflow) End() EndResponse {
 		}
 	}
 
-	f.ended = true
-
 	checkResponseStr := ""
 	if dynamicmeta := f.checkResponse.GetDynamicMetadata(); dynamicmeta != nil {
 		value := dynamicmeta.GetFields()[checkResponseLabel]
@@ -115,7 +157,7 @@ func (f *httpflow) End() EndResponse {
 	}
 
 	f.span.SetAttributes(
-		attribute.String(flowStatusLabel, f.statusCode.String()),
+		attribute.String(flowStatusLabel, statusCode.String()),
 		attribute.String(checkResponseLabel, checkResponseStr),
 		attribute.Int64(flowEndTimestampLabel, time.Now().UnixNano()),
 	)
@@ -165,11 +207,15 @@ func (f *httpflow) End() EndResponse {
 		return EndResponse{}
 	}
 
-	flowEndResponse, err := f.flowControlClient.FlowEnd(context.Background(), &checkv1.FlowEndRequest{
+	flowEndResponse, err := f.flowControlClient.FlowEnd(ctx, &checkv1.FlowEndRequest{
 		ControlPoint:     f.checkResponse.GetCheckResponse().ControlPoint,
 		InflightRequests: inflightRequests,
 	}, f.flowParams.CallOptions...)
 
+	if err != nil {
+		f.metrics.recordFlowEndError(context.Background(), f.controlPoint)
+	}
+
 	return EndResponse{
 		FlowEndResponse: flowEndResponse,
 		Error:           err,
@@ -0,0 +1,175 @@
+package aperture
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LocalCacheOptions configure the in-process cache in front of the result and global caches of Aperture Agent.
+type LocalCacheOptions struct {
+	// MaxEntries is the maximum number of entries kept, the least recently used entry being evicted first. Zero disables the local cache.
+	MaxEntries int
+	// LookupTTL is the TTL of the entries populated from the cache hits served by Aperture Agent, whose remaining TTL is unknown.
+	// Zero keeps only the entries written through SetResultCache and SetGlobalCache, with the TTL of their CacheEntry.
+	LookupTTL time.Duration
+}
+
+// LocalCacheStats are the counters of the local cache, for tuning its size and TTLs.
+type LocalCacheStats struct {
+	// Hits is the number of lookups served by the local cache.
+	Hits uint64
+	// Misses is the number of lookups not found in the local cache, or found expired.
+	Misses uint64
+	// Evictions is the number of entries evicted to stay within LocalCacheOptions.MaxEntries.
+	Evictions uint64
+	// Entries is the current number of entries, including the expired ones not evicted yet.
+	Entries int
+}
+
+// localCacheKey identifies a local cache entry. Result cache keys are scoped by control point, global cache keys are not.
+type localCacheKey struct {
+	controlPoint string
+	key          string
+	global       bool
+}
+
+// resultLocalCacheKey returns the local cache key of a result cache entry.
+func resultLocalCacheKey(controlPoint, key string) localCacheKey {
+	return localCacheKey{controlPoint: controlPoint, key: key}
+}
+
+// globalLocalCacheKey returns the local cache key of a global cache entry.
+func globalLocalCacheKey(key string) localCacheKey {
+	return localCacheKey{key: key, global: true}
+}
+
+type localCacheEntry struct {
+	key       localCacheKey
+	value     []byte
+	expiresAt time.Time
+}
+
+// localCache is a bounded LRU cache whose entries expire after their TTL.
+// Values are copied in and out, so that neither the callers nor the cache see the mutations of the other.
+// A nil *localCache is a disabled cache: lookups miss without being counted and writes are dropped.
+type localCache struct {
+	mu        sync.Mutex
+	opts      LocalCacheOptions
+	entries   map[localCacheKey]*list.Element
+	lru       *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// newLocalCache creates a new local cache. Returns nil if the local cache is disabled.
+func newLocalCache(opts LocalCacheOptions) *localCache {
+	if opts.MaxEntries <= 0 {
+		return nil
+	}
+	return &localCache{
+		opts:    opts,
+		entries: make(map[localCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the value of an unexpired entry, marking it as the most recently used.
+func (lc *localCache) get(key localCacheKey) ([]byte, bool) {
+	if lc == nil {
+		return nil, false
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	element, ok := lc.entries[key]
+	if !ok {
+		lc.misses++
+		return nil, false
+	}
+	entry := element.Value.(*localCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		lc.removeElement(element)
+		lc.misses++
+		return nil, false
+	}
+	lc.lru.MoveToFront(element)
+	lc.hits++
+	return append([]byte(nil), entry.value...), true
+}
+
+// set stores an entry for ttl, evicting the least recently used entries beyond MaxEntries. Entries without a positive TTL are not stored.
+func (lc *localCache) set(key localCacheKey, value []byte, ttl time.Duration) {
+	if lc == nil {
+		return
+	}
+	if ttl <= 0 {
+		lc.delete(key)
+		return
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	value = append([]byte(nil), value...)
+	expiresAt := time.Now().Add(ttl)
+	if element, ok := lc.entries[key]; ok {
+		entry := element.Value.(*localCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		lc.lru.MoveToFront(element)
+		return
+	}
+	lc.entries[key] = lc.lru.PushFront(&localCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for lc.lru.Len() > lc.opts.MaxEntries {
+		lc.removeElement(lc.lru.Back())
+		lc.evictions++
+	}
+}
+
+// setLookup stores an entry served by Aperture Agent for LookupTTL, if set.
+func (lc *localCache) setLookup(key localCacheKey, value []byte) {
+	if lc == nil || lc.opts.LookupTTL <= 0 {
+		return
+	}
+	lc.set(key, value, lc.opts.LookupTTL)
+}
+
+// delete invalidates an entry.
+func (lc *localCache) delete(key localCacheKey) {
+	if lc == nil {
+		return
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if element, ok := lc.entries[key]; ok {
+		lc.removeElement(element)
+	}
+}
+
+// removeElement removes an entry. lc.mu must be held.
+func (lc *localCache) removeElement(element *list.Element) {
+	lc.lru.Remove(element)
+	delete(lc.entries, element.Value.(*localCacheEntry).key)
+}
+
+// stats returns the counters of the local cache.
+func (lc *localCache) stats() LocalCacheStats {
+	if lc == nil {
+		return LocalCacheStats{}
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return LocalCacheStats{
+		Hits:      lc.hits,
+		Misses:    lc.misses,
+		Evictions: lc.evictions,
+		Entries:   lc.lru.Len(),
+	}
+}
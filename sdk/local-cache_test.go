@@ -0,0 +1,87 @@
+package aperture
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	lc := newLocalCache(LocalCacheOptions{MaxEntries: 2})
+
+	lc.set(globalLocalCacheKey("a"), []byte("a"), time.Minute)
+	lc.set(globalLocalCacheKey("b"), []byte("b"), time.Minute)
+	if _, ok := lc.get(globalLocalCacheKey("a")); !ok {
+		t.Fatalf("get(a) missed, want hit")
+	}
+	lc.set(globalLocalCacheKey("c"), []byte("c"), time.Minute)
+
+	if _, ok := lc.get(globalLocalCacheKey("b")); ok {
+		t.Errorf("get(b) hit, want the least recently used entry evicted")
+	}
+	if value, ok := lc.get(globalLocalCacheKey("a")); !ok || string(value) != "a" {
+		t.Errorf("get(a) = %q, %t, want %q, true", value, ok, "a")
+	}
+
+	stats := lc.stats()
+	want := LocalCacheStats{Hits: 2, Misses: 1, Evictions: 1, Entries: 2}
+	if stats != want {
+		t.Errorf("stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestLocalCacheExpiresEntries(t *testing.T) {
+	lc := newLocalCache(LocalCacheOptions{MaxEntries: 10})
+
+	lc.set(resultLocalCacheKey("cp", "key"), []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := lc.get(resultLocalCacheKey("cp", "key")); ok {
+		t.Errorf("get() hit an expired entry")
+	}
+	if got := lc.stats().Entries; got != 0 {
+		t.Errorf("stats().Entries = %d, want 0", got)
+	}
+}
+
+func TestLocalCacheScopesResultKeys(t *testing.T) {
+	lc := newLocalCache(LocalCacheOptions{MaxEntries: 10})
+
+	lc.set(resultLocalCacheKey("first", "key"), []byte("value"), time.Minute)
+
+	if _, ok := lc.get(resultLocalCacheKey("second", "key")); ok {
+		t.Errorf("result cache entry of another control point hit")
+	}
+	if _, ok := lc.get(globalLocalCacheKey("key")); ok {
+		t.Errorf("global cache entry hit a result cache entry")
+	}
+	lc.delete(resultLocalCacheKey("first", "key"))
+	if _, ok := lc.get(resultLocalCacheKey("first", "key")); ok {
+		t.Errorf("deleted entry hit")
+	}
+}
+
+func TestLocalCacheDisabled(t *testing.T) {
+	lc := newLocalCache(LocalCacheOptions{})
+
+	lc.set(globalLocalCacheKey("key"), []byte("value"), time.Minute)
+	if _, ok := lc.get(globalLocalCacheKey("key")); ok {
+		t.Errorf("disabled local cache hit")
+	}
+	if stats := lc.stats(); stats != (LocalCacheStats{}) {
+		t.Errorf("stats() = %+v, want zero", stats)
+	}
+}
+
+func TestLocalCacheCopiesValues(t *testing.T) {
+	lc := newLocalCache(LocalCacheOptions{MaxEntries: 1})
+
+	value := []byte("a")
+	lc.set(globalLocalCacheKey("a"), value, time.Minute)
+	value[0] = 'x'
+	got, _ := lc.get(globalLocalCacheKey("a"))
+	got[0] = 'y'
+
+	if got, _ = lc.get(globalLocalCacheKey("a")); string(got) != "a" {
+		t.Errorf("get(a) = %q, want %q unaffected by the mutations of the callers", got, "a")
+	}
+}
@@ -0,0 +1,134 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metric attribute keys.
+const (
+	// Attribute to hold the control point of the flow.
+	controlPointMetricAttribute = "control_point"
+	// Attribute to hold whether the flow was accepted or rejected.
+	decisionMetricAttribute = "decision"
+	// Attribute to hold which path made the decision.
+	decisionSourceMetricAttribute = "decision_source"
+	// Attribute to hold the status of the flow.
+	flowStatusMetricAttribute = "flow_status"
+	// Attribute to hold the outcome of the Check call.
+	outcomeMetricAttribute = "outcome"
+)
+
+// metrics holds the OpenTelemetry instruments recording the flow decisions made by the SDK.
+type metrics struct {
+	flows            metric.Int64Counter
+	inflightFlows    metric.Int64UpDownCounter
+	checkDuration    metric.Float64Histogram
+	workloadDuration metric.Float64Histogram
+	flowEndErrors    metric.Int64Counter
+}
+
+// newMetrics creates the instruments using a meter of the given MeterProvider.
+func newMetrics(meterProvider metric.MeterProvider) (*metrics, error) {
+	meter := meterProvider.Meter(libraryName, metric.WithInstrumentationVersion(libraryVersion))
+
+	flows, err := meter.Int64Counter("aperture.sdk.flows",
+		metric.WithDescription("Number of flows started, by control point, decision and decision source."),
+		metric.WithUnit("{flow}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	inflightFlows, err := meter.Int64UpDownCounter("aperture.sdk.flows.inflight",
+		metric.WithDescription("Number of flows started but not yet ended."),
+		metric.WithUnit("{flow}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	checkDuration, err := meter.Float64Histogram("aperture.sdk.check.duration",
+		metric.WithDescription("Duration of the Check calls to Aperture Agent."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	workloadDuration, err := meter.Float64Histogram("aperture.sdk.workload.duration",
+		metric.WithDescription("Duration between the flow decision and the end of the flow."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	flowEndErrors, err := meter.Int64Counter("aperture.sdk.flow_end.errors",
+		metric.WithDescription("Number of failed FlowEnd calls to Aperture Agent."),
+		metric.WithUnit("{error}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metrics{
+		flows:            flows,
+		inflightFlows:    inflightFlows,
+		checkDuration:    checkDuration,
+		workloadDuration: workloadDuration,
+		flowEndErrors:    flowEndErrors,
+	}, nil
+}
+
+// recordCheck records the duration and the outcome of a Check call.
+func (m *metrics) recordCheck(ctx context.Context, controlPoint string, duration time.Duration, err error) {
+	outcome := "success"
+	if errors.Is(err, ErrCheckTimeout) {
+		outcome = "timeout"
+	} else if err != nil {
+		outcome = "error"
+	}
+	m.checkDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+		attribute.String(outcomeMetricAttribute, outcome),
+	))
+}
+
+// recordStart records the decision of a started flow.
+func (m *metrics) recordStart(ctx context.Context, controlPoint string, shouldRun bool, decisionSource DecisionSource) {
+	decision := "accepted"
+	if !shouldRun {
+		decision = "rejected"
+	}
+	m.flows.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+		attribute.String(decisionMetricAttribute, decision),
+		attribute.String(decisionSourceMetricAttribute, decisionSource.String()),
+	))
+	m.inflightFlows.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+	))
+}
+
+// recordEnd records the end of a flow and its workload duration.
+func (m *metrics) recordEnd(ctx context.Context, controlPoint string, status FlowStatus, workloadDuration time.Duration) {
+	m.inflightFlows.Add(ctx, -1, metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+	))
+	m.workloadDuration.Record(ctx, workloadDuration.Seconds(), metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+		attribute.String(flowStatusMetricAttribute, status.String()),
+	))
+}
+
+// recordFlowEndError records a failed FlowEnd call.
+func (m *metrics) recordFlowEndError(ctx context.Context, controlPoint string) {
+	m.flowEndErrors.Add(ctx, 1, metric.WithAttributes(
+		attribute.String(controlPointMetricAttribute, controlPoint),
+	))
+}
@@ -0,0 +1,127 @@
+package aperture_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+// recordingMeterProvider is a metric.MeterProvider summing the values recorded by the counters and counting the histogram records,
+// keyed by instrument name and encoded attributes.
+type recordingMeterProvider struct {
+	noop.MeterProvider
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newRecordingMeterProvider() *recordingMeterProvider {
+	return &recordingMeterProvider{values: make(map[string]float64)}
+}
+
+func (p *recordingMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return recordingMeter{provider: p}
+}
+
+// value returns the value recorded by the named instrument with the given attributes.
+func (p *recordingMeterProvider) value(name string, attrs ...attribute.KeyValue) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set := attribute.NewSet(attrs...)
+	return p.values[name+"{"+set.Encoded(attribute.DefaultEncoder())+"}"]
+}
+
+func (p *recordingMeterProvider) record(name string, value float64, attrs attribute.Set) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[name+"{"+attrs.Encoded(attribute.DefaultEncoder())+"}"] += value
+}
+
+type recordingMeter struct {
+	noop.Meter
+	provider *recordingMeterProvider
+}
+
+func (m recordingMeter) Int64Counter(name string, _ ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return recordingInt64Counter{provider: m.provider, name: name}, nil
+}
+
+func (m recordingMeter) Int64UpDownCounter(name string, _ ...metric.Int64UpDownCounterOption) (metric.Int64UpDownCounter, error) {
+	return recordingInt64UpDownCounter{provider: m.provider, name: name}, nil
+}
+
+func (m recordingMeter) Float64Histogram(name string, _ ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return recordingFloat64Histogram{provider: m.provider, name: name}, nil
+}
+
+type recordingInt64Counter struct {
+	noop.Int64Counter
+	provider *recordingMeterProvider
+	name     string
+}
+
+func (c recordingInt64Counter) Add(_ context.Context, incr int64, opts ...metric.AddOption) {
+	c.provider.record(c.name, float64(incr), metric.NewAddConfig(opts).Attributes())
+}
+
+type recordingInt64UpDownCounter struct {
+	noop.Int64UpDownCounter
+	provider *recordingMeterProvider
+	name     string
+}
+
+func (c recordingInt64UpDownCounter) Add(_ context.Context, incr int64, opts ...metric.AddOption) {
+	c.provider.record(c.name, float64(incr), metric.NewAddConfig(opts).Attributes())
+}
+
+type recordingFloat64Histogram struct {
+	noop.Float64Histogram
+	provider *recordingMeterProvider
+	name     string
+}
+
+func (h recordingFloat64Histogram) Record(_ context.Context, _ float64, opts ...metric.RecordOption) {
+	h.provider.record(h.name, 1, metric.NewRecordConfig(opts).Attributes())
+}
+
+func TestMetrics(t *testing.T) {
+	meterProvider := newRecordingMeterProvider()
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{MeterProvider: meterProvider})
+	agent.SetDecision("rejected", aperturetest.Decision{Reject: true})
+	agent.SetDecision("slow", aperturetest.Decision{Delay: time.Second})
+	ctx := context.Background()
+
+	accepted := client.StartFlow(ctx, "accepted", aperture.FlowParams{})
+	if got := meterProvider.value("aperture.sdk.flows.inflight", attribute.String("control_point", "accepted")); got != 1 {
+		t.Errorf("in-flight flows = %v, want 1", got)
+	}
+	accepted.SetStatus(aperture.Error)
+	accepted.End()
+	client.StartFlow(ctx, "rejected", aperture.FlowParams{}).End()
+	client.StartFlow(ctx, "slow", aperture.FlowParams{Timeout: 10 * time.Millisecond}).End()
+
+	for _, tc := range []struct {
+		name  string
+		attrs []attribute.KeyValue
+		want  float64
+	}{
+		{"aperture.sdk.flows", []attribute.KeyValue{attribute.String("control_point", "accepted"), attribute.String("decision", "accepted"), attribute.String("decision_source", "Agent")}, 1},
+		{"aperture.sdk.flows", []attribute.KeyValue{attribute.String("control_point", "rejected"), attribute.String("decision", "rejected"), attribute.String("decision_source", "Agent")}, 1},
+		{"aperture.sdk.flows", []attribute.KeyValue{attribute.String("control_point", "slow"), attribute.String("decision", "accepted"), attribute.String("decision_source", "FailureMode")}, 1},
+		{"aperture.sdk.flows.inflight", []attribute.KeyValue{attribute.String("control_point", "accepted")}, 0},
+		{"aperture.sdk.check.duration", []attribute.KeyValue{attribute.String("control_point", "accepted"), attribute.String("outcome", "success")}, 1},
+		{"aperture.sdk.check.duration", []attribute.KeyValue{attribute.String("control_point", "slow"), attribute.String("outcome", "timeout")}, 1},
+		{"aperture.sdk.workload.duration", []attribute.KeyValue{attribute.String("control_point", "accepted"), attribute.String("flow_status", "Error")}, 1},
+	} {
+		if got := meterProvider.value(tc.name, tc.attrs...); got != tc.want {
+			t.Errorf("%s%v = %v, want %v", tc.name, tc.attrs, got, tc.want)
+		}
+	}
+}
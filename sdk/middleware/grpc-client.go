@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+)
+
+// retryAfterMetadataKey is the metadata key which carries the retry-after duration (in seconds) of a rejected outbound call.
+const retryAfterMetadataKey = "retry-after"
+
+// GRPCUnaryClientInterceptor takes a control point name and creates a UnaryClientInterceptor which can be used with gRPC client.
+// Every outbound call is started as a flow; rejected calls are not sent and fail with codes.ResourceExhausted.
+func GRPCUnaryClientInterceptor(c aperture.Client, controlPoint string, flowParams aperture.FlowParams) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		flow := startClientFlow(ctx, c, controlPoint, method, flowParams)
+
+		defer func() {
+			// Need to call End() on the Flow in order to provide telemetry to Aperture Agent for completing the control loop.
+			resp := flow.End()
+			if resp.Error != nil {
+				c.GetLogger().Info("Aperture flow control end got error.", "error", resp.Error)
+			}
+		}()
+
+		if !flow.ShouldRun() {
+			return clientRejectionError(flow, method, opts)
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			flow.SetStatus(aperture.Error)
+		}
+		return err
+	}
+}
+
+// GRPCStreamClientInterceptor takes a control point name and creates a StreamClientInterceptor which can be used with gRPC client.
+// The flow is started when the stream is opened and ended once the stream finishes: when RecvMsg returns an error, including io.EOF,
+// when the response of a stream without server streaming (e.g. CloseAndRecv of a client-streaming call) is received, or when ctx is done.
+func GRPCStreamClientInterceptor(c aperture.Client, controlPoint string, flowParams aperture.FlowParams) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		flow := startClientFlow(ctx, c, controlPoint, method, flowParams)
+
+		if !flow.ShouldRun() {
+			endClientFlow(c, flow, nil)
+			return nil, clientRejectionError(flow, method, opts)
+		}
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			endClientFlow(c, flow, err)
+			return nil, err
+		}
+
+		s := &flowClientStream{
+			ClientStream:  cs,
+			client:        c,
+			flow:          flow,
+			serverStreams: desc.ServerStreams,
+			done:          make(chan struct{}),
+		}
+		// End the flow if the stream is abandoned by cancelling its context.
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.end(ctx.Err())
+			case <-s.done:
+			}
+		}()
+		return s, nil
+	}
+}
+
+// flowClientStream wraps a grpc.ClientStream and ends the flow once the stream finishes.
+type flowClientStream struct {
+	grpc.ClientStream
+	client        aperture.Client
+	flow          aperture.Flow
+	serverStreams bool
+	endOnce       sync.Once
+	done          chan struct{}
+}
+
+// RecvMsg receives a message from the underlying stream and ends the flow when the stream finishes.
+// Without server streaming, the single response completes the stream, as its caller never receives io.EOF.
+func (s *flowClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.serverStreams {
+		s.end(err)
+	}
+	return err
+}
+
+// SendMsg sends a message on the underlying stream and ends the flow if the stream is broken.
+func (s *flowClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil && err != io.EOF {
+		s.end(err)
+	}
+	return err
+}
+
+// end ends the flow exactly once. io.EOF denotes a successfully completed stream.
+func (s *flowClientStream) end(err error) {
+	s.endOnce.Do(func() {
+		close(s.done)
+		if err == io.EOF {
+			err = nil
+		}
+		endClientFlow(s.client, s.flow, err)
+	})
+}
+
+// startClientFlow starts a flow for an outbound gRPC call, labelled with the method and the outgoing metadata.
+func startClientFlow(ctx context.Context, c aperture.Client, controlPoint string, method string, flowParams aperture.FlowParams) aperture.Flow {
+	labels := make(map[string]string, len(flowParams.Labels))
+	for key, value := range flowParams.Labels {
+		labels[key] = value
+	}
+	// override labels with labels from outgoing metadata
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		for key, value := range md {
+			labels[key] = strings.Join(value, ",")
+		}
+	}
+	// full method has the form "/package.service/method"
+	if service, rpcMethod, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/"); ok {
+		labels["rpc.service"] = service
+		labels["rpc.method"] = rpcMethod
+	}
+	flowParams.Labels = labels
+
+	flow := c.StartFlow(ctx, controlPoint, flowParams)
+	if flow.Error() != nil {
+		c.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
+	}
+	return flow
+}
+
+// endClientFlow ends the flow of an outbound call, marking it as failed if the call returned an error.
+func endClientFlow(c aperture.Client, flow aperture.Flow, err error) {
+	if err != nil {
+		flow.SetStatus(aperture.Error)
+	}
+	resp := flow.End()
+	if resp.Error != nil {
+		c.GetLogger().Info("Aperture flow control end got error.", "error", resp.Error)
+	}
+}
+
+// clientRejectionError returns a codes.ResourceExhausted error for a rejected outbound call.
+// The retry-after duration is attached as errdetails.RetryInfo and set in the trailer requested via grpc.Trailer call option, if any.
+// Calls rejected because the Check call failed fail with codes.Unavailable instead.
+func clientRejectionError(flow aperture.Flow, method string, opts []grpc.CallOption) error {
+	rejection := flow.RejectionError()
+	if flow.CheckResponse() == nil {
+		return status.Errorf(codes.Unavailable, "Aperture flow control is unavailable, rejected the outbound call to %s: %v", method, rejection)
+	}
+
+	retryAfter := rejection.RetryAfter
+
+	for _, opt := range opts {
+		if trailerOpt, ok := opt.(grpc.TrailerCallOption); ok && trailerOpt.TrailerAddr != nil {
+			*trailerOpt.TrailerAddr = metadata.Pairs(retryAfterMetadataKey, strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+		}
+	}
+
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("Aperture rejected the outbound call to %s: %v", method, rejection))
+	stWithDetails, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return stWithDetails.Err()
+}
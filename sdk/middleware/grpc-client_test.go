@@ -0,0 +1,362 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	"github.com/fluxninja/aperture-go/v2/sdk/middleware"
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+)
+
+// testServiceName is the name of the gRPC service served by newTestConn.
+const testServiceName = "aperture.test.Test"
+
+// errTestHandler is the error returned by the handlers of a failing testServer.
+var errTestHandler = status.Error(codes.Internal, "handler failed")
+
+// testService serves unary and streaming methods exchanging empty messages. Each streaming method handles two messages.
+var testService = grpc.ServiceDesc{
+	ServiceName: testServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Unary",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(emptypb.Empty)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return new(emptypb.Empty), srv.(*testServer).err
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + testServiceName + "/Unary"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ClientStream",
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				if err := recvAll(stream); err != nil {
+					return err
+				}
+				if err := srv.(*testServer).err; err != nil {
+					return err
+				}
+				return stream.SendMsg(new(emptypb.Empty))
+			},
+		},
+		{
+			StreamName:    "ServerStream",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+					return err
+				}
+				for i := 0; i < 2; i++ {
+					if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+						return err
+					}
+				}
+				return srv.(*testServer).err
+			},
+		},
+		{
+			StreamName:    "BidiStream",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				for {
+					in := new(emptypb.Empty)
+					err := stream.RecvMsg(in)
+					if errors.Is(err, io.EOF) {
+						return srv.(*testServer).err
+					}
+					if err != nil {
+						return err
+					}
+					if err = stream.SendMsg(in); err != nil {
+						return err
+					}
+				}
+			},
+		},
+	},
+}
+
+// testServer is the implementation of testService. Its handlers return err once they have handled the messages.
+type testServer struct {
+	err error
+}
+
+// recvAll receives the messages of stream until the client closes it.
+func recvAll(stream grpc.ServerStream) error {
+	for {
+		err := stream.RecvMsg(new(emptypb.Empty))
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newTestConn serves testService with the given server options and returns a connection to it dialled with the given dial options.
+func newTestConn(t *testing.T, server *testServer, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(serverOpts...)
+	grpcServer.RegisterService(&testService, server)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	dialOpts = append(dialOpts,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	conn, err := grpc.Dial("passthrough:///bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("failed to dial the test server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// newStream opens a stream of the given testService method.
+func newStream(t *testing.T, ctx context.Context, conn *grpc.ClientConn, streamName string) grpc.ClientStream {
+	t.Helper()
+	for i := range testService.Streams {
+		desc := &testService.Streams[i]
+		if desc.StreamName == streamName {
+			stream, err := conn.NewStream(ctx, desc, "/"+testServiceName+"/"+streamName)
+			if err != nil {
+				t.Fatalf("NewStream(%s) error = %v", streamName, err)
+			}
+			return stream
+		}
+	}
+	t.Fatalf("unknown stream %s", streamName)
+	return nil
+}
+
+func TestGRPCUnaryClientInterceptor(t *testing.T) {
+	client := aperturetest.NewClient()
+	conn := newTestConn(t, &testServer{}, nil,
+		grpc.WithUnaryInterceptor(middleware.GRPCUnaryClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+	if err := conn.Invoke(context.Background(), "/"+testServiceName+"/Unary", new(emptypb.Empty), new(emptypb.Empty)); err != nil {
+		t.Fatalf("Invoke() error = %v", err)
+	}
+
+	flows := client.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("flows = %d, want 1", len(flows))
+	}
+	flows[0].AssertEnded(t, aperture.OK)
+	labels := client.FlowRequests()[0].FlowParams.Labels
+	if labels["rpc.service"] != testServiceName || labels["rpc.method"] != "Unary" {
+		t.Errorf("labels = %v, want the rpc.service and rpc.method of the call", labels)
+	}
+}
+
+func TestGRPCUnaryClientInterceptorError(t *testing.T) {
+	client := aperturetest.NewClient()
+	conn := newTestConn(t, &testServer{err: errTestHandler}, nil,
+		grpc.WithUnaryInterceptor(middleware.GRPCUnaryClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+	err := conn.Invoke(context.Background(), "/"+testServiceName+"/Unary", new(emptypb.Empty), new(emptypb.Empty))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Invoke() error = %v, want code %s", err, codes.Internal)
+	}
+	client.Flows()[0].AssertEnded(t, aperture.Error)
+}
+
+func TestGRPCUnaryClientInterceptorRejected(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetDefaultFlowOptions(aperturetest.FlowOptions{
+		Reject:        true,
+		RetryAfter:    2 * time.Second,
+		CheckResponse: rejectedCheckResponse(),
+	})
+	server := &testServer{}
+	conn := newTestConn(t, server, []grpc.ServerOption{grpc.UnaryInterceptor(failIfCalled(t))},
+		grpc.WithUnaryInterceptor(middleware.GRPCUnaryClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+	err := conn.Invoke(context.Background(), "/"+testServiceName+"/Unary", new(emptypb.Empty), new(emptypb.Empty))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Invoke() error = %v, want code %s", err, codes.ResourceExhausted)
+	}
+	client.Flows()[0].AssertEnded(t, aperture.OK)
+}
+
+func TestGRPCStreamClientInterceptor(t *testing.T) {
+	tests := []struct {
+		name       string
+		streamName string
+		exchange   func(stream grpc.ClientStream) error
+	}{
+		{
+			name:       "client streaming",
+			streamName: "ClientStream",
+			exchange: func(stream grpc.ClientStream) error {
+				for i := 0; i < 2; i++ {
+					if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+						return err
+					}
+				}
+				// CloseAndRecv of the generated clients: the caller never receives io.EOF.
+				if err := stream.CloseSend(); err != nil {
+					return err
+				}
+				return stream.RecvMsg(new(emptypb.Empty))
+			},
+		},
+		{
+			name:       "server streaming",
+			streamName: "ServerStream",
+			exchange: func(stream grpc.ClientStream) error {
+				if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+					return err
+				}
+				if err := stream.CloseSend(); err != nil {
+					return err
+				}
+				return recvUntilEOF(stream)
+			},
+		},
+		{
+			name:       "bidirectional streaming",
+			streamName: "BidiStream",
+			exchange: func(stream grpc.ClientStream) error {
+				for i := 0; i < 2; i++ {
+					if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+						return err
+					}
+					if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+						return err
+					}
+				}
+				if err := stream.CloseSend(); err != nil {
+					return err
+				}
+				return recvUntilEOF(stream)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := aperturetest.NewClient()
+			conn := newTestConn(t, &testServer{}, nil,
+				grpc.WithStreamInterceptor(middleware.GRPCStreamClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+			// The context is never cancelled, so only the completion of the stream ends the flow.
+			stream := newStream(t, context.Background(), conn, tt.streamName)
+			if err := tt.exchange(stream); err != nil {
+				t.Fatalf("stream error = %v", err)
+			}
+
+			flows := client.Flows()
+			if len(flows) != 1 {
+				t.Fatalf("flows = %d, want 1", len(flows))
+			}
+			flows[0].AssertEnded(t, aperture.OK)
+		})
+	}
+}
+
+func TestGRPCStreamClientInterceptorError(t *testing.T) {
+	for _, streamName := range []string{"ClientStream", "ServerStream", "BidiStream"} {
+		t.Run(streamName, func(t *testing.T) {
+			client := aperturetest.NewClient()
+			conn := newTestConn(t, &testServer{err: errTestHandler}, nil,
+				grpc.WithStreamInterceptor(middleware.GRPCStreamClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+			stream := newStream(t, context.Background(), conn, streamName)
+			if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+				t.Fatalf("SendMsg() error = %v", err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatalf("CloseSend() error = %v", err)
+			}
+			if err := recvUntilEOF(stream); status.Code(err) != codes.Internal {
+				t.Fatalf("stream error = %v, want code %s", err, codes.Internal)
+			}
+
+			client.Flows()[0].AssertEnded(t, aperture.Error)
+		})
+	}
+}
+
+func TestGRPCStreamClientInterceptorCancelled(t *testing.T) {
+	client := aperturetest.NewClient()
+	conn := newTestConn(t, &testServer{}, nil,
+		grpc.WithStreamInterceptor(middleware.GRPCStreamClientInterceptor(client, "outbound", aperture.FlowParams{})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	newStream(t, ctx, conn, "BidiStream")
+	cancel()
+
+	flow := client.Flows()[0]
+	waitFor(t, func() bool { return len(flow.EndStatuses()) > 0 })
+	flow.AssertEnded(t, aperture.Error)
+}
+
+// recvUntilEOF receives messages from stream until it finishes. Returns nil if it finished successfully.
+func recvUntilEOF(stream grpc.ClientStream) error {
+	for {
+		err := stream.RecvMsg(new(emptypb.Empty))
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rejectedCheckResponse returns the response of Aperture Agent rejecting a flow.
+func rejectedCheckResponse() *checkv1.CheckResponse {
+	return &checkv1.CheckResponse{DecisionType: checkv1.CheckResponse_DECISION_TYPE_REJECTED}
+}
+
+// failIfCalled returns a unary server interceptor failing the test if a call reaches the server.
+func failIfCalled(t *testing.T) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		t.Errorf("rejected call to %s reached the server", info.FullMethod)
+		return handler(ctx, req)
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -11,11 +11,14 @@ import (
 	"strconv"
 	"strings"
 
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	aperture "github.com/fluxninja/aperture-go/v2/sdk"
 	"github.com/fluxninja/aperture-go/v2/sdk/utils"
@@ -45,42 +48,99 @@ func socketAddressFromNetAddr(addr net.Addr) *checkhttpv1.SocketAddress {
 	}
 }
 
+// compileIgnoredPaths precompiles the regex patterns for ignored paths into middlewareParams.IgnoredPathsCompiled.
+func compileIgnoredPaths(middlewareParams *aperture.MiddlewareParams) error {
+	if middlewareParams.IgnoredPaths == nil {
+		return nil
+	}
+	compiledIgnoredPaths := make([]*regexp.Regexp, len(middlewareParams.IgnoredPaths))
+	for i, pattern := range middlewareParams.IgnoredPaths {
+		compiledPattern, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		compiledIgnoredPaths[i] = compiledPattern
+	}
+	middlewareParams.IgnoredPathsCompiled = compiledIgnoredPaths
+	return nil
+}
+
+// isIgnoredPath returns whether the path matches any of the compiled ignored path patterns.
+func isIgnoredPath(middlewareParams aperture.MiddlewareParams, path string) bool {
+	for _, ignoredPath := range middlewareParams.IgnoredPathsCompiled {
+		if ignoredPath.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // NewGRPCMiddleware takes a control point name and creates a UnaryInterceptor which can be used with gRPC server.
 func NewGRPCMiddleware(client aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams) (grpc.UnaryServerInterceptor, error) {
-	// Precompile the regex patterns for ignored paths
-	if middlewareParams.IgnoredPaths != nil {
-		compiledIgnoredPaths := make([]*regexp.Regexp, len(middlewareParams.IgnoredPaths))
-		for i, pattern := range middlewareParams.IgnoredPaths {
-			compiledPattern, err := regexp.Compile(pattern)
-			if err != nil {
-				return nil, err
-			} else {
-				compiledIgnoredPaths[i] = compiledPattern
-			}
-		}
-		middlewareParams.IgnoredPathsCompiled = compiledIgnoredPaths
+	if err := compileIgnoredPaths(&middlewareParams); err != nil {
+		return nil, err
 	}
 
 	return GRPCUnaryInterceptor(client, controlPoint, middlewareParams), nil
 }
 
+// NewGRPCStreamMiddleware takes a control point name and creates a StreamInterceptor which can be used with gRPC server.
+func NewGRPCStreamMiddleware(client aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams) (grpc.StreamServerInterceptor, error) {
+	if err := compileIgnoredPaths(&middlewareParams); err != nil {
+		return nil, err
+	}
+
+	return GRPCStreamInterceptor(client, controlPoint, middlewareParams), nil
+}
+
+// defaultGRPCErrorCodes are the gRPC status codes which are classified as flow errors if MiddlewareParams.GRPCErrorCodes is not set.
+var defaultGRPCErrorCodes = []codes.Code{
+	codes.Unknown,
+	codes.DeadlineExceeded,
+	codes.Unimplemented,
+	codes.Internal,
+	codes.Unavailable,
+	codes.DataLoss,
+}
+
+// grpcErrorCodeSet returns the set of gRPC status codes which are classified as flow errors.
+func grpcErrorCodeSet(middlewareParams aperture.MiddlewareParams) map[codes.Code]struct{} {
+	errorCodes := middlewareParams.GRPCErrorCodes
+	if errorCodes == nil {
+		errorCodes = defaultGRPCErrorCodes
+	}
+	errorCodeSet := make(map[codes.Code]struct{}, len(errorCodes))
+	for _, code := range errorCodes {
+		errorCodeSet[code] = struct{}{}
+	}
+	return errorCodeSet
+}
+
+// setGRPCFlowStatus records the gRPC status code of the handler error on the flow span and
+// sets the flow status to Error if the code is in errorCodeSet.
+func setGRPCFlowStatus(flow aperture.HTTPFlow, err error, errorCodeSet map[codes.Code]struct{}) {
+	code := status.Code(err)
+	flow.Span().SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if _, ok := errorCodeSet[code]; ok {
+		flow.SetStatus(aperture.Error)
+	}
+}
+
 // GRPCUnaryInterceptor takes a control point name and creates a UnaryInterceptor which can be used with gRPC server.
+// The flow status is set to Error if the handler returns an error with one of MiddlewareParams.GRPCErrorCodes.
 func GRPCUnaryInterceptor(c aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams) grpc.UnaryServerInterceptor {
+	errorCodeSet := grpcErrorCodeSet(middlewareParams)
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		// If the path is ignored, skip the middleware
-		if middlewareParams.IgnoredPathsCompiled != nil {
-			for _, ignoredPath := range middlewareParams.IgnoredPathsCompiled {
-				if ignoredPath.MatchString(info.FullMethod) {
-					return handler(ctx, req)
-				}
-			}
+		if isIgnoredPath(middlewareParams, info.FullMethod) {
+			return handler(ctx, req)
 		}
 
 		checkReq := prepareCheckHTTPRequestForGRPC(ctx, req, c.GetLogger(), info.FullMethod, controlPoint, middlewareParams.FlowParams)
 
 		flow := c.StartHTTPFlow(ctx, checkReq, middlewareParams)
 		if flow.Error() != nil {
-			c.GetLogger().Info("Aperture flow control got error. Returned flow defaults to Allowed.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
+			c.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
 		}
 
 		defer func() {
@@ -96,17 +156,158 @@ func GRPCUnaryInterceptor(c aperture.Client, controlPoint string, middlewarePara
 		}()
 
 		if !flow.ShouldRun() {
-			rejectResp := flow.CheckResponse().GetDeniedResponse()
-			return nil, status.Error(
-				convertHTTPStatusToGRPC(rejectResp.GetStatus()),
-				fmt.Sprintf("Aperture rejected the request: %v", rejectResp.GetBody()),
-			)
+			return nil, rejectionStatusError(flow, middlewareParams)
 		}
 
-		return handler(ctx, req)
+		resp, err := handler(ctx, req)
+		setGRPCFlowStatus(flow, err, errorCodeSet)
+		return resp, err
 	}
 }
 
+// GRPCStreamInterceptor takes a control point name and creates a StreamInterceptor which can be used with gRPC server.
+// The stream is checked once when it is opened. If MiddlewareParams.PerMessageFlow is set, every message received on the stream is additionally gated as its own flow.
+// A rejected message is not delivered to the handler: RecvMsg returns the rejection status error instead, and handlers returning it end the stream.
+// The flow status is set to Error if the handler returns an error with one of MiddlewareParams.GRPCErrorCodes.
+func GRPCStreamInterceptor(c aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams) grpc.StreamServerInterceptor {
+	errorCodeSet := grpcErrorCodeSet(middlewareParams)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		// If the path is ignored, skip the middleware
+		if isIgnoredPath(middlewareParams, info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		ctx := ss.Context()
+		checkReq := prepareCheckHTTPRequestForGRPC(ctx, nil, c.GetLogger(), info.FullMethod, controlPoint, middlewareParams.FlowParams)
+
+		flow := c.StartHTTPFlow(ctx, checkReq, middlewareParams)
+		if flow.Error() != nil {
+			c.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
+		}
+
+		defer func() {
+			// Need to call End() on the Flow in order to provide telemetry to Aperture Agent for completing the control loop.
+			resp := flow.End()
+			if resp.Error != nil {
+				c.GetLogger().Info("Aperture flow control end got error.", "error", resp.Error)
+			}
+
+			c.GetLogger().Info("Aperture flow control end.", "resp", resp)
+		}()
+
+		if !flow.ShouldRun() {
+			return rejectionStatusError(flow, middlewareParams)
+		}
+
+		var ms *messageFlowServerStream
+		if middlewareParams.PerMessageFlow {
+			ms = &messageFlowServerStream{
+				ServerStream:     ss,
+				client:           c,
+				controlPoint:     controlPoint,
+				fullMethod:       info.FullMethod,
+				middlewareParams: middlewareParams,
+				errorCodeSet:     errorCodeSet,
+			}
+			ss = ms
+		}
+
+		err := handler(srv, ss)
+		if ms != nil {
+			ms.endMessageFlow(err)
+		}
+		setGRPCFlowStatus(flow, err, errorCodeSet)
+		return err
+	}
+}
+
+// messageFlowServerStream wraps a grpc.ServerStream and gates every received message as its own flow.
+// The flow of a message is ended successfully when the handler asks for the next message, as it is done with the previous one.
+// The flow of the last message is ended with the outcome of the handler.
+type messageFlowServerStream struct {
+	grpc.ServerStream
+	client           aperture.Client
+	controlPoint     string
+	fullMethod       string
+	middlewareParams aperture.MiddlewareParams
+	errorCodeSet     map[codes.Code]struct{}
+	flow             aperture.HTTPFlow
+}
+
+// RecvMsg receives a message from the underlying stream and performs a flow check for it.
+func (s *messageFlowServerStream) RecvMsg(m interface{}) error {
+	s.endMessageFlow(nil)
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	// The message is only encoded if Aperture Agent should extract flow labels from it.
+	var body interface{}
+	if s.middlewareParams.PerMessageFlowBody {
+		body = m
+	}
+	ctx := s.Context()
+	checkReq := prepareCheckHTTPRequestForGRPC(ctx, body, s.client.GetLogger(), s.fullMethod, s.controlPoint, s.middlewareParams.FlowParams)
+
+	s.flow = s.client.StartHTTPFlow(ctx, checkReq, s.middlewareParams)
+	if s.flow.Error() != nil {
+		s.client.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", s.flow.Error().Error(), "flow.ShouldRun()", s.flow.ShouldRun())
+	}
+
+	if !s.flow.ShouldRun() {
+		rejectErr := rejectionStatusError(s.flow, s.middlewareParams)
+		s.endMessageFlow(nil)
+		return rejectErr
+	}
+
+	return nil
+}
+
+// endMessageFlow ends the flow of the previously received message, if any.
+// The flow is marked as failed if err, returned by the handler, has one of MiddlewareParams.GRPCErrorCodes.
+func (s *messageFlowServerStream) endMessageFlow(err error) {
+	if s.flow == nil {
+		return
+	}
+	if err != nil {
+		setGRPCFlowStatus(s.flow, err, s.errorCodeSet)
+	}
+	resp := s.flow.End()
+	if resp.Error != nil {
+		s.client.GetLogger().Info("Aperture flow control end got error.", "error", resp.Error)
+	}
+	s.flow = nil
+}
+
+// rejectionStatusError converts the denied response of a rejected flow into a gRPC status error, as described by HTTPFlow.RejectionError().
+// If the flow was rejected because the Check call failed, MiddlewareParams.FailClosedResponse is used instead.
+// The retry-after duration, if advised, is attached as errdetails.RetryInfo.
+func rejectionStatusError(flow aperture.HTTPFlow, middlewareParams aperture.MiddlewareParams) error {
+	rejection := flow.RejectionError()
+	statusCode := rejection.HTTPStatusCode
+	body := flow.CheckResponse().GetDeniedResponse().GetBody()
+	if flow.CheckResponse().GetDeniedResponse() == nil {
+		failClosedResp := failClosedResponse(middlewareParams)
+		statusCode = failClosedResp.StatusCode
+		body = failClosedResp.Body
+	}
+
+	st := status.New(
+		convertHTTPStatusToGRPC(int32(statusCode)),
+		fmt.Sprintf("Aperture rejected the request: %v", body),
+	)
+	if rejection.RetryAfter <= 0 {
+		return st.Err()
+	}
+	stWithDetails, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(rejection.RetryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return stWithDetails.Err()
+}
+
 // PrepareCheckHTTPRequestForGRPC takes a gRPC request, context, unary server-info, logger and Control Point to use in Aperture policy for preparing the flowcontrolhttp.CheckHTTPRequest and returns it.
 func prepareCheckHTTPRequestForGRPC(ctx context.Context, req interface{}, logger *slog.Logger, fullMethod string, controlPoint string, flowParams aperture.FlowParams) *checkhttpv1.CheckHTTPRequest {
 	labels := utils.LabelsFromCtx(ctx)
@@ -148,9 +349,14 @@ func prepareCheckHTTPRequestForGRPC(ctx context.Context, req interface{}, logger
 		Port:     0,
 	}
 
-	body, err := json.Marshal(req)
-	if err != nil {
-		logger.Error("Failed to marshal request body", "error", err)
+	// Streams are checked before any message is received, so there is no body to marshal.
+	body := []byte{}
+	if req != nil {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			logger.Error("Failed to marshal request body", "error", err)
+		}
 	}
 
 	return &checkhttpv1.CheckHTTPRequest{
@@ -198,6 +404,8 @@ func convertHTTPStatusToGRPC(httpStatusCode int32) codes.Code {
 		return codes.Unimplemented
 	case http.StatusUnauthorized:
 		return codes.Unauthenticated
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
 	default:
 		return codes.Unknown
 	}
@@ -0,0 +1,223 @@
+package middleware_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	"github.com/fluxninja/aperture-go/v2/sdk/middleware"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// rejectingClient is a test double of aperture.Client rejecting the HTTP flows it starts after the first accepted ones.
+type rejectingClient struct {
+	*aperturetest.Client
+	mu       sync.Mutex
+	accepted int
+	rejected []*aperturetest.HTTPFlow
+}
+
+func (c *rejectingClient) StartHTTPFlow(ctx context.Context, request *checkhttpv1.CheckHTTPRequest, middlewareParams aperture.MiddlewareParams) aperture.HTTPFlow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accepted > 0 {
+		c.accepted--
+		return c.Client.StartHTTPFlow(ctx, request, middlewareParams)
+	}
+	flow := aperturetest.NewHTTPFlow(aperturetest.FlowOptions{
+		Reject:            true,
+		DecisionSource:    aperture.DecisionSourceAgent,
+		CheckHTTPResponse: deniedCheckHTTPResponse(429),
+	})
+	c.rejected = append(c.rejected, flow)
+	return flow
+}
+
+// exchangeBidi sends n messages on a BidiStream, receiving their echoes, and returns the status of the stream.
+func exchangeBidi(t *testing.T, conn *grpc.ClientConn, n int) error {
+	t.Helper()
+	stream := newStream(t, context.Background(), conn, "BidiStream")
+	for i := 0; i < n; i++ {
+		if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+			return recvUntilEOF(stream)
+		}
+		if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return recvUntilEOF(stream)
+}
+
+func TestGRPCUnaryInterceptor(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		errorCode []codes.Code
+		want      aperture.FlowStatus
+	}{
+		{name: "ok", want: aperture.OK},
+		{name: "error", err: errTestHandler, want: aperture.Error},
+		{name: "client error", err: status.Error(codes.NotFound, "not found"), want: aperture.OK},
+		{name: "custom error codes", err: status.Error(codes.NotFound, "not found"), errorCode: []codes.Code{codes.NotFound}, want: aperture.Error},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := aperturetest.NewClient()
+			interceptor, err := middleware.NewGRPCMiddleware(client, "inbound", aperture.MiddlewareParams{GRPCErrorCodes: tc.errorCode})
+			if err != nil {
+				t.Fatalf("NewGRPCMiddleware() error = %v", err)
+			}
+			conn := newTestConn(t, &testServer{err: tc.err}, []grpc.ServerOption{grpc.UnaryInterceptor(interceptor)})
+
+			err = conn.Invoke(context.Background(), "/"+testServiceName+"/Unary", new(emptypb.Empty), new(emptypb.Empty))
+			if status.Code(err) != status.Code(tc.err) {
+				t.Fatalf("Invoke() error = %v, want code %s", err, status.Code(tc.err))
+			}
+			client.HTTPFlows()[0].AssertEnded(t, tc.want)
+		})
+	}
+}
+
+func TestGRPCUnaryInterceptorRejected(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetDefaultFlowOptions(aperturetest.FlowOptions{
+		Reject:            true,
+		DecisionSource:    aperture.DecisionSourceAgent,
+		CheckHTTPResponse: deniedCheckHTTPResponse(429),
+	})
+	interceptor, err := middleware.NewGRPCMiddleware(client, "inbound", aperture.MiddlewareParams{})
+	if err != nil {
+		t.Fatalf("NewGRPCMiddleware() error = %v", err)
+	}
+	conn := newTestConn(t, &testServer{}, []grpc.ServerOption{grpc.ChainUnaryInterceptor(interceptor, failIfCalled(t))})
+
+	err = conn.Invoke(context.Background(), "/"+testServiceName+"/Unary", new(emptypb.Empty), new(emptypb.Empty))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Invoke() error = %v, want code %s", err, codes.ResourceExhausted)
+	}
+	client.HTTPFlows()[0].AssertEnded(t, aperture.OK)
+}
+
+func TestGRPCStreamInterceptorPerMessageFlow(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want []aperture.FlowStatus
+	}{
+		{name: "ok", want: []aperture.FlowStatus{aperture.OK, aperture.OK, aperture.OK}},
+		// The handler asked for the next message, so it was done with both messages when it failed.
+		{name: "error after the messages", err: errTestHandler, want: []aperture.FlowStatus{aperture.Error, aperture.OK, aperture.OK}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := aperturetest.NewClient()
+			interceptor, err := middleware.NewGRPCStreamMiddleware(client, "inbound", aperture.MiddlewareParams{PerMessageFlow: true})
+			if err != nil {
+				t.Fatalf("NewGRPCStreamMiddleware() error = %v", err)
+			}
+			conn := newTestConn(t, &testServer{err: tc.err}, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)})
+
+			if err = exchangeBidi(t, conn, 2); status.Code(err) != status.Code(tc.err) {
+				t.Fatalf("stream error = %v, want code %s", err, status.Code(tc.err))
+			}
+
+			flows := client.HTTPFlows()
+			if len(flows) != len(tc.want) {
+				t.Fatalf("flows = %d, want the flow of the stream and one per message", len(flows))
+			}
+			for i, flow := range flows {
+				flow.AssertEnded(t, tc.want[i])
+			}
+		})
+	}
+}
+
+func TestGRPCStreamInterceptorPerMessageFlowHandlerError(t *testing.T) {
+	client := aperturetest.NewClient()
+	interceptor, err := middleware.NewGRPCStreamMiddleware(client, "inbound", aperture.MiddlewareParams{PerMessageFlow: true})
+	if err != nil {
+		t.Fatalf("NewGRPCStreamMiddleware() error = %v", err)
+	}
+	conn := newTestConn(t, &testServer{err: errTestHandler}, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)})
+
+	// The handler of ServerStream fails while processing its single message.
+	stream := newStream(t, context.Background(), conn, "ServerStream")
+	if err = stream.SendMsg(new(emptypb.Empty)); err != nil {
+		t.Fatalf("SendMsg() error = %v", err)
+	}
+	if err = stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend() error = %v", err)
+	}
+	if err = recvUntilEOF(stream); status.Code(err) != codes.Internal {
+		t.Fatalf("stream error = %v, want code %s", err, codes.Internal)
+	}
+
+	flows := client.HTTPFlows()
+	if len(flows) != 2 {
+		t.Fatalf("flows = %d, want the flow of the stream and of the message", len(flows))
+	}
+	flows[0].AssertEnded(t, aperture.Error)
+	flows[1].AssertEnded(t, aperture.Error)
+}
+
+func TestGRPCStreamInterceptorRejectedMessage(t *testing.T) {
+	client := &rejectingClient{Client: aperturetest.NewClient(), accepted: 2}
+	interceptor, err := middleware.NewGRPCStreamMiddleware(client, "inbound", aperture.MiddlewareParams{PerMessageFlow: true})
+	if err != nil {
+		t.Fatalf("NewGRPCStreamMiddleware() error = %v", err)
+	}
+	conn := newTestConn(t, &testServer{}, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)})
+
+	// The first message is accepted and echoed, the second one is rejected, failing the stream.
+	if err = exchangeBidi(t, conn, 2); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("stream error = %v, want code %s", err, codes.ResourceExhausted)
+	}
+
+	for _, flow := range client.HTTPFlows() {
+		flow.AssertEnded(t, aperture.OK)
+	}
+	client.rejected[0].AssertEnded(t, aperture.OK)
+}
+
+func TestGRPCStreamInterceptorPerMessageFlowBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body bool
+		want string
+	}{
+		{name: "default", want: ""},
+		{name: "opted in", body: true, want: "{}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+			interceptor, err := middleware.NewGRPCStreamMiddleware(client, "inbound", aperture.MiddlewareParams{
+				PerMessageFlow:     true,
+				PerMessageFlowBody: tc.body,
+			})
+			if err != nil {
+				t.Fatalf("NewGRPCStreamMiddleware() error = %v", err)
+			}
+			conn := newTestConn(t, &testServer{}, []grpc.ServerOption{grpc.StreamInterceptor(interceptor)})
+
+			if err = exchangeBidi(t, conn, 1); err != nil {
+				t.Fatalf("stream error = %v", err)
+			}
+
+			requests := agent.CheckHTTPRequests()
+			if len(requests) != 2 {
+				t.Fatalf("CheckHTTP requests = %d, want 2", len(requests))
+			}
+			if got := requests[1].GetRequest().GetBody(); got != tc.want {
+				t.Errorf("body of the message flow = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
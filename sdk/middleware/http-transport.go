@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/utils"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+type httpTransport struct {
+	client           aperture.Client
+	controlPoint     string
+	middlewareParams aperture.MiddlewareParams
+	base             http.RoundTripper
+}
+
+// NewHTTPTransport creates a new http.RoundTripper which wraps every outbound request in an Aperture flow.
+// Requests are passed on to base, or to http.DefaultTransport if base is nil.
+// Rejected requests are not sent; instead a synthetic 429 Too Many Requests response is returned,
+// or MiddlewareParams.FailClosedResponse if the request was rejected because the Check call failed.
+func NewHTTPTransport(client aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams, base http.RoundTripper) (http.RoundTripper, error) {
+	if err := compileIgnoredPaths(&middlewareParams); err != nil {
+		return nil, err
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &httpTransport{
+		client:           client,
+		controlPoint:     controlPoint,
+		middlewareParams: middlewareParams,
+		base:             base,
+	}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *httpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// If the path is ignored, skip the transport
+	if isIgnoredPath(t.middlewareParams, req.URL.Path) {
+		return t.base.RoundTrip(req)
+	}
+
+	checkReq := prepareCheckHTTPRequestForHTTPClient(req, t.client.GetLogger(), t.controlPoint, t.middlewareParams.FlowParams)
+
+	flow := t.client.StartHTTPFlow(req.Context(), checkReq, t.middlewareParams)
+	if flow.Error() != nil {
+		t.client.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
+	}
+
+	if !flow.ShouldRun() {
+		t.endFlow(flow)
+		// The request is not sent, but a RoundTripper must close its body anyway.
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return rejectedHTTPResponse(req, flow, t.middlewareParams), nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		flow.SetStatus(aperture.Error)
+		t.endFlow(flow)
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		flow.SetStatus(aperture.Error)
+	}
+
+	// The flow is ended once the caller is done reading the response body.
+	body := &flowResponseBody{
+		ReadCloser: resp.Body,
+		end: func() {
+			t.endFlow(flow)
+		},
+	}
+	// The body of a 101 Switching Protocols response must remain writable, it is the upgraded connection.
+	if writer, ok := resp.Body.(io.Writer); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &flowReadWriteBody{flowResponseBody: body, Writer: writer}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// endFlow ends the flow of an outbound request.
+func (t *httpTransport) endFlow(flow aperture.HTTPFlow) {
+	// Need to call End() on the Flow in order to provide telemetry to Aperture Agent for completing the control loop.
+	resp := flow.End()
+	if resp.Error != nil {
+		t.client.GetLogger().Info("Aperture flow control end got error.", "error", resp.Error)
+	}
+}
+
+// flowResponseBody wraps a response body and ends the flow once the body is fully read or closed.
+type flowResponseBody struct {
+	io.ReadCloser
+	endOnce sync.Once
+	end     func()
+}
+
+// Read reads from the underlying body and ends the flow on EOF.
+func (b *flowResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.endOnce.Do(b.end)
+	}
+	return n, err
+}
+
+// Close closes the underlying body and ends the flow.
+func (b *flowResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.endOnce.Do(b.end)
+	return err
+}
+
+// flowReadWriteBody is a flowResponseBody which keeps the underlying body of an upgraded connection writable.
+type flowReadWriteBody struct {
+	*flowResponseBody
+	io.Writer
+}
+
+// rejectedHTTPResponse builds a synthetic 429 Too Many Requests response for a rejected outbound request,
+// with the headers and body of the denied response of Aperture Agent, whatever its status code.
+// If the flow was rejected because the Check call failed, MiddlewareParams.FailClosedResponse is used instead.
+func rejectedHTTPResponse(req *http.Request, flow aperture.HTTPFlow, middlewareParams aperture.MiddlewareParams) *http.Response {
+	statusCode, header, body := rejectionHTTPResponse(flow, middlewareParams)
+	if flow.CheckResponse().GetDeniedResponse() != nil {
+		statusCode = http.StatusTooManyRequests
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// prepareCheckHTTPRequestForHTTPClient takes an outbound http.Request and prepares the flowcontrolhttp.CheckHTTPRequest for it.
+// Unlike prepareCheckHTTPRequestForHTTP, the source is the local host and the destination is the remote host.
+// The body is not included, as reading it would consume the outbound request body.
+func prepareCheckHTTPRequestForHTTPClient(req *http.Request, logger *slog.Logger, controlPoint string, flowParams aperture.FlowParams) *checkhttpv1.CheckHTTPRequest {
+	labels := httpRequestLabels(req, flowParams)
+
+	protocol := checkhttpv1.SocketAddress_TCP
+
+	destinationHost := req.URL.Hostname()
+	destinationPort := req.URL.Port()
+	if destinationPort == "" {
+		destinationPort = "80"
+		if req.URL.Scheme == "https" {
+			destinationPort = "443"
+		}
+	}
+	destinationPortU32, err := strconv.ParseUint(destinationPort, 10, 32)
+	if err != nil {
+		logger.Error("Failed to parse destination port", "error", err)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	return &checkhttpv1.CheckHTTPRequest{
+		Source: &checkhttpv1.SocketAddress{
+			Address:  utils.GetLocalIP(),
+			Protocol: protocol,
+			Port:     0,
+		},
+		Destination: &checkhttpv1.SocketAddress{
+			Address:  destinationHost,
+			Protocol: protocol,
+			Port:     uint32(destinationPortU32),
+		},
+		ControlPoint: controlPoint,
+		RampMode:     flowParams.RampMode,
+		ExpectEnd:    true,
+		Request: &checkhttpv1.CheckHTTPRequest_HttpRequest{
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Host:     host,
+			Headers:  labels,
+			Scheme:   req.URL.Scheme,
+			Size:     req.ContentLength,
+			Protocol: req.Proto,
+		},
+	}
+}
@@ -0,0 +1,190 @@
+package middleware_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	"github.com/fluxninja/aperture-go/v2/sdk/middleware"
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+)
+
+// trackingBody is a request body recording whether it was closed.
+type trackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+// newTestTransportClient returns an HTTP client whose transport is wrapped in flows started by client.
+func newTestTransportClient(t *testing.T, client aperture.Client) *http.Client {
+	t.Helper()
+	transport, err := middleware.NewHTTPTransport(client, "outbound", aperture.MiddlewareParams{}, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPTransport() error = %v", err)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// deniedCheckHTTPResponse returns the response of Aperture Agent denying a request with the given status code.
+func deniedCheckHTTPResponse(statusCode int32) *checkhttpv1.CheckHTTPResponse {
+	return &checkhttpv1.CheckHTTPResponse{
+		Status: &status.Status{Code: int32(code.Code_UNAVAILABLE)},
+		HttpResponse: &checkhttpv1.CheckHTTPResponse_DeniedResponse{
+			DeniedResponse: &checkhttpv1.DeniedHttpResponse{Status: statusCode, Body: "denied"},
+		},
+	}
+}
+
+func TestHTTPTransportEndsFlowWithBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	client := aperturetest.NewClient()
+
+	resp, err := newTestTransportClient(t, client).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	flow := client.HTTPFlows()[0]
+	flow.AssertNotEnded(t)
+
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	flow.AssertEnded(t, aperture.OK)
+}
+
+func TestHTTPTransportServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := aperturetest.NewClient()
+
+	resp, err := newTestTransportClient(t, client).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	client.HTTPFlows()[0].AssertEnded(t, aperture.Error)
+}
+
+func TestHTTPTransportRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("rejected request reached the server")
+	}))
+	defer server.Close()
+	client := aperturetest.NewClient()
+	checkHTTPResponse := deniedCheckHTTPResponse(http.StatusTooManyRequests)
+	checkHTTPResponse.CheckResponse = &checkv1.CheckResponse{WaitTime: durationpb.New(2 * time.Second)}
+	client.SetDefaultFlowOptions(aperturetest.FlowOptions{
+		DecisionSource:    aperture.DecisionSourceAgent,
+		CheckHTTPResponse: checkHTTPResponse,
+	})
+
+	body := &trackingBody{Reader: strings.NewReader("payload")}
+	req, err := http.NewRequest(http.MethodPost, server.URL, body)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	resp, err := newTestTransportClient(t, client).Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+	if !body.closed {
+		t.Errorf("request body of the rejected request was not closed")
+	}
+	client.HTTPFlows()[0].AssertEnded(t, aperture.OK)
+}
+
+func TestHTTPTransportRejectedIsTooManyRequests(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetDefaultFlowOptions(aperturetest.FlowOptions{
+		Reject:            true,
+		DecisionSource:    aperture.DecisionSourceAgent,
+		CheckHTTPResponse: deniedCheckHTTPResponse(http.StatusServiceUnavailable),
+	})
+
+	resp, err := newTestTransportClient(t, client).Get("http://example.invalid")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "denied" {
+		t.Errorf("body = %q, want the denied response body", body)
+	}
+}
+
+func TestHTTPTransportSwitchingProtocols(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		_ = rw.Flush()
+		// Echo a line over the upgraded connection.
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString(line)
+		_ = rw.Flush()
+	}))
+	defer server.Close()
+	client := aperturetest.NewClient()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	resp, err := newTestTransportClient(t, client).Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status code = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("body of a 101 response is %T, want an io.ReadWriteCloser", resp.Body)
+	}
+	if _, err = io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len("ping\n"))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping\n" {
+		t.Fatalf("read %q, %v, want the echoed line", buf, err)
+	}
+	_ = conn.Close()
+	client.HTTPFlows()[0].AssertEnded(t, aperture.OK)
+}
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
 	aperture "github.com/fluxninja/aperture-go/v2/sdk"
 	"github.com/fluxninja/aperture-go/v2/sdk/utils"
 	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
@@ -29,18 +31,12 @@ type httpMiddleware struct {
 
 // NewHTTPMiddleware creates a new HTTPMiddleware struct.
 func NewHTTPMiddleware(client aperture.Client, controlPoint string, middlewareParams aperture.MiddlewareParams) (HTTPMiddleware, error) {
-	// Precompile the regex patterns for ignored paths
-	if middlewareParams.IgnoredPaths != nil {
-		compiledIgnoredPaths := make([]*regexp.Regexp, len(middlewareParams.IgnoredPaths))
-		for i, pattern := range middlewareParams.IgnoredPaths {
-			compiledPattern, err := regexp.Compile(pattern)
-			if err != nil {
-				return nil, err
-			} else {
-				compiledIgnoredPaths[i] = compiledPattern
-			}
-		}
-		middlewareParams.IgnoredPathsCompiled = compiledIgnoredPaths
+	if err := compileIgnoredPaths(&middlewareParams); err != nil {
+		return nil, err
+	}
+
+	if middlewareParams.IsHTTPError == nil {
+		middlewareParams.IsHTTPError = isServerError
 	}
 
 	return &httpMiddleware{
@@ -54,20 +50,16 @@ func NewHTTPMiddleware(client aperture.Client, controlPoint string, middlewarePa
 func (m *httpMiddleware) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// If the path is ignored, skip the middleware
-		if m.middlewareParams.IgnoredPathsCompiled != nil {
-			for _, compiledPattern := range m.middlewareParams.IgnoredPathsCompiled {
-				if compiledPattern.MatchString(r.URL.Path) {
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
+		if isIgnoredPath(m.middlewareParams, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
 		}
 
 		req := prepareCheckHTTPRequestForHTTP(r, m.client.GetLogger(), m.controlPoint, m.middlewareParams.FlowParams)
 
 		flow := m.client.StartHTTPFlow(r.Context(), req, m.middlewareParams)
 		if flow.Error() != nil {
-			m.client.GetLogger().Info("Aperture flow control got error. Returned flow defaults to Allowed.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
+			m.client.GetLogger().Info("Aperture flow control got error. Returned flow is decided by the failure mode.", "flow.Error()", flow.Error().Error(), "flow.ShouldRun()", flow.ShouldRun())
 		}
 
 		defer func() {
@@ -83,27 +75,91 @@ func (m *httpMiddleware) Handle(next http.Handler) http.Handler {
 		}()
 
 		if flow.ShouldRun() {
-			next.ServeHTTP(w, r)
-		} else {
-			resp := flow.CheckResponse().GetDeniedResponse()
-			// If there was connection error, the response will be nil.
-			if resp == nil {
-				w.WriteHeader(http.StatusServiceUnavailable)
-			} else {
-				w.WriteHeader(int(resp.GetStatus()))
-				for key, value := range resp.GetHeaders() {
-					w.Header().Set(key, value)
-				}
-				_, err := fmt.Fprint(w, resp.GetBody())
-				if err != nil {
-					m.client.GetLogger().Info("Aperture flow control respond body got an error.", "error", err)
+			// A panicking handler fails the flow, which the deferred End() then ends before the panic propagates.
+			served := false
+			defer func() {
+				if !served {
+					flow.SetStatus(aperture.Error)
 				}
+			}()
+
+			rw, handlerWriter := newResponseWriter(w)
+			next.ServeHTTP(handlerWriter, r)
+			served = true
+
+			flow.Span().SetAttributes(
+				semconv.HTTPStatusCodeKey.Int(rw.statusCode),
+				semconv.HTTPResponseContentLengthKey.Int64(rw.bytesWritten),
+			)
+			if m.middlewareParams.IsHTTPError(rw.statusCode) {
+				flow.SetStatus(aperture.Error)
+			}
+		} else {
+			statusCode, header, body := rejectionHTTPResponse(flow, m.middlewareParams)
+			if err := writeHTTPResponse(w, statusCode, header, body); err != nil {
+				m.client.GetLogger().Info("Aperture flow control respond body got an error.", "error", err)
 			}
 		}
 	})
 }
 
-func prepareCheckHTTPRequestForHTTP(req *http.Request, logger *slog.Logger, controlPoint string, flowParams aperture.FlowParams) *checkhttpv1.CheckHTTPRequest {
+// rejectionHTTPResponse returns the status code, headers and body of the response to a rejected flow, as described by HTTPFlow.RejectionError().
+// The denied response of Aperture Agent is used if any, otherwise MiddlewareParams.FailClosedResponse.
+// A Retry-After header is added if the retry-after duration is advised and the response does not set it.
+func rejectionHTTPResponse(flow aperture.HTTPFlow, middlewareParams aperture.MiddlewareParams) (int, http.Header, string) {
+	rejection := flow.RejectionError()
+	statusCode := rejection.HTTPStatusCode
+	header := make(http.Header)
+	var body string
+
+	// If there was connection error, the denied response will be nil.
+	if deniedResp := flow.CheckResponse().GetDeniedResponse(); deniedResp != nil {
+		for key, value := range deniedResp.GetHeaders() {
+			header.Set(key, value)
+		}
+		body = deniedResp.GetBody()
+	} else {
+		failClosedResp := failClosedResponse(middlewareParams)
+		statusCode = failClosedResp.StatusCode
+		for key, value := range failClosedResp.Headers {
+			header.Set(key, value)
+		}
+		body = failClosedResp.Body
+	}
+
+	if rejection.RetryAfter > 0 && header.Get("Retry-After") == "" {
+		header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(rejection.RetryAfter.Seconds())), 10))
+	}
+	return statusCode, header, body
+}
+
+// writeHTTPResponse writes a response with the given status code, headers and body.
+func writeHTTPResponse(w http.ResponseWriter, statusCode int, header http.Header, body string) error {
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(statusCode)
+	_, err := fmt.Fprint(w, body)
+	return err
+}
+
+// failClosedResponse returns MiddlewareParams.FailClosedResponse, defaulting the status code to 503 Service Unavailable.
+func failClosedResponse(middlewareParams aperture.MiddlewareParams) aperture.FailClosedResponse {
+	resp := middlewareParams.FailClosedResponse
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusServiceUnavailable
+	}
+	return resp
+}
+
+// isServerError is the default MiddlewareParams.IsHTTPError, classifying 5xx responses as errors.
+func isServerError(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError
+}
+
+// httpRequestLabels returns the labels of the CheckHTTP request for req: the baggage of its context,
+// overridden by the explicit labels of flowParams, overridden by its headers.
+func httpRequestLabels(req *http.Request, flowParams aperture.FlowParams) map[string]string {
 	labels := utils.LabelsFromCtx(req.Context())
 
 	// override labels with explicit labels
@@ -119,6 +175,12 @@ func prepareCheckHTTPRequestForHTTP(req *http.Request, logger *slog.Logger, cont
 		labels[key] = strings.Join(value, ",")
 	}
 
+	return labels
+}
+
+func prepareCheckHTTPRequestForHTTP(req *http.Request, logger *slog.Logger, controlPoint string, flowParams aperture.FlowParams) *checkhttpv1.CheckHTTPRequest {
+	labels := httpRequestLabels(req, flowParams)
+
 	// We know that the protocol is TCP because Golang's http package doesn't support UDP
 	// TODO: Should we support `httpu`?
 	protocol := checkhttpv1.SocketAddress_TCP
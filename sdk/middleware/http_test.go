@@ -0,0 +1,226 @@
+package middleware_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+	"github.com/fluxninja/aperture-go/v2/sdk/middleware"
+)
+
+// newTestHandler wraps handler in the HTTP middleware using flows started by client.
+func newTestHandler(t *testing.T, client aperture.Client, handler http.HandlerFunc) http.Handler {
+	t.Helper()
+	m, err := middleware.NewHTTPMiddleware(client, "inbound", aperture.MiddlewareParams{})
+	if err != nil {
+		t.Fatalf("NewHTTPMiddleware() error = %v", err)
+	}
+	return m.Handle(handler)
+}
+
+func TestHTTPMiddlewareEndsFlow(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		statusCode int
+		want       aperture.FlowStatus
+	}{
+		{name: "ok", statusCode: http.StatusOK, want: aperture.OK},
+		{name: "client error", statusCode: http.StatusNotFound, want: aperture.OK},
+		{name: "server error", statusCode: http.StatusInternalServerError, want: aperture.Error},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := aperturetest.NewClient()
+			handler := newTestHandler(t, client, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCode)
+			})
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if recorder.Code != tc.statusCode {
+				t.Errorf("status code = %d, want %d", recorder.Code, tc.statusCode)
+			}
+			client.HTTPFlows()[0].AssertEnded(t, tc.want)
+		})
+	}
+}
+
+func TestHTTPMiddlewareRejected(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetDefaultFlowOptions(aperturetest.FlowOptions{
+		Reject:            true,
+		DecisionSource:    aperture.DecisionSourceAgent,
+		HTTPStatusCode:    http.StatusServiceUnavailable,
+		CheckHTTPResponse: deniedCheckHTTPResponse(http.StatusServiceUnavailable),
+	})
+	handler := newTestHandler(t, client, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler of a rejected request was called")
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if body := recorder.Body.String(); body != "denied" {
+		t.Errorf("body = %q, want the denied response body", body)
+	}
+	client.HTTPFlows()[0].AssertEnded(t, aperture.OK)
+}
+
+func TestHTTPMiddlewarePanicEndsWithError(t *testing.T) {
+	client := aperturetest.NewClient()
+	handler := newTestHandler(t, client, func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the panic of the handler", r)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	client.HTTPFlows()[0].AssertEnded(t, aperture.Error)
+}
+
+func TestHTTPMiddlewareResponseWriterCapabilities(t *testing.T) {
+	// capabilities reports which optional interfaces w implements.
+	capabilities := func(w http.ResponseWriter) string {
+		var names []string
+		if _, ok := w.(http.Flusher); ok {
+			names = append(names, "Flusher")
+		}
+		if _, ok := w.(http.Hijacker); ok {
+			names = append(names, "Hijacker")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			names = append(names, "Pusher")
+		}
+		if _, ok := w.(io.ReaderFrom); ok {
+			names = append(names, "ReaderFrom")
+		}
+		return strings.Join(names, ",")
+	}
+
+	t.Run("recorder", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		var got string
+		handler := newTestHandler(t, aperturetest.NewClient(), func(w http.ResponseWriter, r *http.Request) {
+			got = capabilities(w)
+		})
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if want := capabilities(recorder); got != want {
+			t.Errorf("capabilities = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		var got, want string
+		client := aperturetest.NewClient()
+		wrapped := newTestHandler(t, client, func(w http.ResponseWriter, r *http.Request) {
+			got = capabilities(w)
+			_, _ = io.Copy(w, strings.NewReader("ok"))
+		})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want = capabilities(w)
+			wrapped.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if got != want {
+			t.Errorf("capabilities = %q, want %q", got, want)
+		}
+		if string(body) != "ok" {
+			t.Errorf("body = %q, want %q", body, "ok")
+		}
+		client.HTTPFlows()[0].AssertEnded(t, aperture.OK)
+	})
+}
+
+// roundTripperFunc is an http.RoundTripper calling the function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestHTTPRequestLabels(t *testing.T) {
+	member := func(key, value string) baggage.Member {
+		m, err := baggage.NewMember(key, value)
+		if err != nil {
+			t.Fatalf("NewMember() error = %v", err)
+		}
+		return m
+	}
+	bag, err := baggage.New(member("user", "alice"), member("tier", "free"))
+	if err != nil {
+		t.Fatalf("baggage.New() error = %v", err)
+	}
+	params := aperture.MiddlewareParams{FlowParams: aperture.FlowParams{
+		Labels: map[string]string{"tier": "gold", "X-Plan": "explicit"},
+	}}
+	// Baggage is overridden by the explicit labels, which are overridden by the headers.
+	want := map[string]string{"user": "alice", "tier": "gold", "X-Plan": "header"}
+
+	for _, tc := range []struct {
+		name string
+		do   func(t *testing.T, client aperture.Client, req *http.Request)
+	}{
+		{name: "middleware", do: func(t *testing.T, client aperture.Client, req *http.Request) {
+			m, err := middleware.NewHTTPMiddleware(client, "inbound", params)
+			if err != nil {
+				t.Fatalf("NewHTTPMiddleware() error = %v", err)
+			}
+			m.Handle(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+		}},
+		{name: "transport", do: func(t *testing.T, client aperture.Client, req *http.Request) {
+			transport, err := middleware.NewHTTPTransport(client, "outbound", params, roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			}))
+			if err != nil {
+				t.Fatalf("NewHTTPTransport() error = %v", err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req = req.WithContext(baggage.ContextWithBaggage(req.Context(), bag))
+			req.Header.Set("X-Plan", "header")
+
+			tc.do(t, client, req)
+
+			requests := agent.CheckHTTPRequests()
+			if len(requests) != 1 {
+				t.Fatalf("CheckHTTP requests = %d, want 1", len(requests))
+			}
+			labels := requests[0].GetRequest().GetHeaders()
+			for key, value := range want {
+				if labels[key] != value {
+					t.Errorf("label %q = %q, want %q", key, labels[key], value)
+				}
+			}
+		})
+	}
+}
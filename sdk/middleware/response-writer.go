@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps a http.ResponseWriter and records the status code and the number of bytes written by the handler.
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+	wroteHeader  bool
+}
+
+// newResponseWriter returns a new responseWriter wrapping w, along with the http.ResponseWriter to pass to the handler.
+// The latter implements exactly those of http.Flusher, http.Hijacker, http.Pusher and io.ReaderFrom which w implements,
+// so that handlers probing for them with type assertions see the same capabilities as without the middleware.
+func newResponseWriter(w http.ResponseWriter) (*responseWriter, http.ResponseWriter) {
+	rw := &responseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+	}
+
+	var capabilities int
+	if _, ok := w.(http.Flusher); ok {
+		capabilities |= 1
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		capabilities |= 2
+	}
+	if _, ok := w.(http.Pusher); ok {
+		capabilities |= 4
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		capabilities |= 8
+	}
+
+	f, h, p, rf := responseWriterFlusher{rw}, responseWriterHijacker{rw}, responseWriterPusher{rw}, responseWriterReaderFrom{rw}
+	switch capabilities {
+	case 1:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+		}{rw, f}
+	case 2:
+		return rw, struct {
+			*responseWriter
+			http.Hijacker
+		}{rw, h}
+	case 3:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case 4:
+		return rw, struct {
+			*responseWriter
+			http.Pusher
+		}{rw, p}
+	case 5:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Pusher
+		}{rw, f, p}
+	case 6:
+		return rw, struct {
+			*responseWriter
+			http.Hijacker
+			http.Pusher
+		}{rw, h, p}
+	case 7:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rw, f, h, p}
+	case 8:
+		return rw, struct {
+			*responseWriter
+			io.ReaderFrom
+		}{rw, rf}
+	case 9:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{rw, f, rf}
+	case 10:
+		return rw, struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, h, rf}
+	case 11:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, f, h, rf}
+	case 12:
+		return rw, struct {
+			*responseWriter
+			http.Pusher
+			io.ReaderFrom
+		}{rw, p, rf}
+	case 13:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, p, rf}
+	case 14:
+		return rw, struct {
+			*responseWriter
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, h, p, rf}
+	case 15:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, h, p, rf}
+	default:
+		return rw, rw
+	}
+}
+
+// WriteHeader records the status code and writes it to the wrapped http.ResponseWriter.
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.statusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the number of bytes written to the wrapped http.ResponseWriter.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for use by http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseWriterFlusher delegates http.Flusher to the wrapped http.ResponseWriter.
+type responseWriterFlusher struct{ *responseWriter }
+
+// Flush implements http.Flusher.
+func (w responseWriterFlusher) Flush() {
+	w.wroteHeader = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// responseWriterHijacker delegates http.Hijacker to the wrapped http.ResponseWriter.
+type responseWriterHijacker struct{ *responseWriter }
+
+// Hijack implements http.Hijacker.
+func (w responseWriterHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// responseWriterPusher delegates http.Pusher to the wrapped http.ResponseWriter.
+type responseWriterPusher struct{ *responseWriter }
+
+// Push implements http.Pusher.
+func (w responseWriterPusher) Push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// responseWriterReaderFrom delegates io.ReaderFrom to the wrapped http.ResponseWriter.
+type responseWriterReaderFrom struct{ *responseWriter }
+
+// ReadFrom implements io.ReaderFrom, recording the number of bytes written.
+func (w responseWriterReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.bytesWritten += n
+	return n, err
+}
@@ -0,0 +1,100 @@
+package aperture
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+)
+
+// ErrRejected is matched by errors.Is for the errors returned when a flow was not allowed to run.
+var ErrRejected = errors.New("flow was rejected")
+
+// LimiterRef identifies a limiter of a policy.
+type LimiterRef struct {
+	PolicyName  string
+	PolicyHash  string
+	ComponentID string
+}
+
+// RejectionError describes why a flow was not allowed to run. It matches ErrRejected and unwraps to the error of the Check call, if any.
+type RejectionError struct {
+	// ControlPoint is the control point of the rejected flow.
+	ControlPoint string
+	// DecisionSource is the path which rejected the flow.
+	DecisionSource DecisionSource
+	// RejectReason is the reason Aperture Agent rejected the flow for.
+	RejectReason checkv1.CheckResponse_RejectReason
+	// RetryAfter is the time after which the flow can be retried, if advised by Aperture Agent.
+	RetryAfter time.Duration
+	// HTTPStatusCode is the HTTP status code the rejection should be responded with.
+	// Flows rejected by their FailureMode or FallbackPolicy are responded with 503 Service Unavailable, those rejected by Aperture Agent
+	// with the denied response status code, defaulting to 429 Too Many Requests.
+	HTTPStatusCode int
+	// DroppedBy are the limiters which dropped the flow.
+	DroppedBy []LimiterRef
+	// Err is the error of the Check call if the flow was not rejected by Aperture Agent.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *RejectionError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "flow at control point %q was rejected", e.ControlPoint)
+	if e.DecisionSource != DecisionSourceAgent {
+		fmt.Fprintf(&sb, " by %s", e.DecisionSource)
+		if e.Err != nil {
+			fmt.Fprintf(&sb, ": %v", e.Err)
+		}
+	} else if e.RejectReason != checkv1.CheckResponse_REJECT_REASON_NONE {
+		fmt.Fprintf(&sb, ": %s", e.RejectReason)
+	}
+	if e.RetryAfter > 0 {
+		fmt.Fprintf(&sb, ", retry after %s", e.RetryAfter)
+	}
+	return sb.String()
+}
+
+// Is reports whether target is ErrRejected.
+func (e *RejectionError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// Unwrap returns the error of the Check call, if any.
+func (e *RejectionError) Unwrap() error {
+	return e.Err
+}
+
+// newRejectionError describes the rejection of a flow from the Check response, or from the error of the Check call if there is no response.
+func newRejectionError(controlPoint string, decisionSource DecisionSource, checkResponse *checkv1.CheckResponse, err error) *RejectionError {
+	rejection := &RejectionError{
+		ControlPoint:   controlPoint,
+		DecisionSource: decisionSource,
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		Err:            err,
+	}
+	if checkResponse == nil {
+		return rejection
+	}
+
+	rejection.RejectReason = checkResponse.GetRejectReason()
+	rejection.RetryAfter = checkResponse.GetWaitTime().AsDuration()
+	rejection.HTTPStatusCode = http.StatusTooManyRequests
+	if statusCode := checkResponse.GetDeniedResponseStatusCode(); statusCode != checkv1.StatusCode_Empty {
+		rejection.HTTPStatusCode = int(statusCode)
+	}
+	for _, decision := range checkResponse.GetLimiterDecisions() {
+		if !decision.GetDropped() {
+			continue
+		}
+		rejection.DroppedBy = append(rejection.DroppedBy, LimiterRef{
+			PolicyName:  decision.GetPolicyName(),
+			PolicyHash:  decision.GetPolicyHash(),
+			ComponentID: decision.GetComponentId(),
+		})
+	}
+	return rejection
+}
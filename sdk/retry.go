@@ -0,0 +1,41 @@
+package aperture
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries flows rejected by Aperture Agent, waiting for the retry-after duration advised by Aperture Agent between attempts.
+// Flows rejected without a retry-after duration, or by their FailureMode, are not retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of Check calls, including the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// MaxWait bounds the total time spent waiting between attempts. Zero means the waits are bound only by the deadline of the context.
+	MaxWait time.Duration
+	// Jitter is the fraction, between 0 and 1, of the retry-after duration by which each wait is randomly lengthened or shortened.
+	// Values above 1 are treated as 1, so that the wait never goes negative.
+	Jitter float64
+}
+
+// wait returns how long to wait before retrying a flow, or false if the flow should not be retried.
+// A retry is abandoned if the wait would exceed MaxWait in total, or the deadline of ctx.
+func (p RetryPolicy) wait(ctx context.Context, f Flow, waited time.Duration) (time.Duration, bool) {
+	if f.ShouldRun() {
+		return 0, false
+	}
+	wait := f.RetryAfter()
+	if wait <= 0 {
+		return 0, false
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * min(p.Jitter, 1) * (2*rand.Float64() - 1))
+	}
+	if p.MaxWait > 0 && waited+wait > p.MaxWait {
+		return 0, false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,86 @@
+package aperture_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		decision     aperturetest.Decision
+		retryPolicy  aperture.RetryPolicy
+		deadline     time.Duration
+		wantAttempts int
+	}{
+		{name: "disabled", decision: aperturetest.Decision{Reject: true, WaitTime: 10 * time.Millisecond}, wantAttempts: 1},
+		{name: "max attempts", decision: aperturetest.Decision{Reject: true, WaitTime: 10 * time.Millisecond}, retryPolicy: aperture.RetryPolicy{MaxAttempts: 3}, wantAttempts: 3},
+		{name: "no retry-after", decision: aperturetest.Decision{Reject: true}, retryPolicy: aperture.RetryPolicy{MaxAttempts: 3}, wantAttempts: 1},
+		{name: "max wait", decision: aperturetest.Decision{Reject: true, WaitTime: 10 * time.Millisecond}, retryPolicy: aperture.RetryPolicy{MaxAttempts: 3, MaxWait: 15 * time.Millisecond}, wantAttempts: 2},
+		{name: "deadline", decision: aperturetest.Decision{Reject: true, WaitTime: time.Second}, retryPolicy: aperture.RetryPolicy{MaxAttempts: 3}, deadline: 100 * time.Millisecond, wantAttempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+			agent.SetDefaultDecision(tc.decision)
+
+			ctx := context.Background()
+			if tc.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				defer cancel()
+			}
+			flow := client.StartFlow(ctx, "test", aperture.FlowParams{RetryPolicy: tc.retryPolicy})
+			defer flow.End()
+
+			if flow.ShouldRun() {
+				t.Errorf("ShouldRun() = true, want the flow rejected")
+			}
+			if got := flow.Attempts(); got != tc.wantAttempts {
+				t.Errorf("Attempts() = %d, want %d", got, tc.wantAttempts)
+			}
+			if got := len(agent.CheckRequests()); got != tc.wantAttempts {
+				t.Errorf("Check requests = %d, want %d", got, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyAcceptedRetry(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDefaultDecision(aperturetest.Decision{Reject: true, WaitTime: 50 * time.Millisecond})
+	go func() {
+		for len(agent.CheckRequests()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		agent.SetDefaultDecision(aperturetest.Decision{})
+	}()
+
+	flow := client.StartFlow(context.Background(), "test", aperture.FlowParams{RetryPolicy: aperture.RetryPolicy{MaxAttempts: 3}})
+	defer flow.End()
+
+	if !flow.ShouldRun() {
+		t.Errorf("ShouldRun() = false, want the retry accepted")
+	}
+	if got := flow.Attempts(); got != 2 {
+		t.Errorf("Attempts() = %d, want 2", got)
+	}
+}
+
+func TestRetryPolicyJitterIsClamped(t *testing.T) {
+	client, agent := aperturetest.NewTestClient(t, aperture.Options{})
+	agent.SetDefaultDecision(aperturetest.Decision{Reject: true, WaitTime: 10 * time.Millisecond})
+	// Clamped to 1, the jitter keeps every wait between 0 and twice the retry-after duration, hence within MaxWait.
+	retryPolicy := aperture.RetryPolicy{MaxAttempts: 2, MaxWait: 20 * time.Millisecond, Jitter: 10}
+
+	for i := 0; i < 20; i++ {
+		flow := client.StartFlow(context.Background(), "test", aperture.FlowParams{RetryPolicy: retryPolicy})
+		flow.End()
+		if got := flow.Attempts(); got != 2 {
+			t.Fatalf("Attempts() = %d, want 2", got)
+		}
+	}
+}
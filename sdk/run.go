@@ -0,0 +1,64 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// RunParams configures a workload run by Run.
+type RunParams struct {
+	FlowParams
+	// ResultCacheTTL enables the result cache if FlowParams.ResultCacheKey is set. The workload is skipped on a result cache hit,
+	// otherwise its JSON encoded result is stored in the result cache with this TTL once it succeeds.
+	ResultCacheTTL time.Duration
+}
+
+// Run runs fn as the workload of a flow started at controlPoint.
+// If the flow is not allowed to run, fn is not called and a *RejectionError matching ErrRejected is returned.
+// The flow is always ended, with the Error status if fn returns an error or panics, in which case the panic is propagated once the flow has ended.
+// Flows which are rejected or served from the result cache end with the status left unset, as fn did not run.
+func Run[T any](ctx context.Context, client Client, controlPoint string, params RunParams, fn func(ctx context.Context) (T, error)) (result T, err error) {
+	flow := client.StartFlow(ctx, controlPoint, params.FlowParams)
+	ran, panicked := false, true
+	defer func() {
+		if ran && (panicked || err != nil) {
+			flow.SetStatus(Error)
+		}
+		if endResponse := flow.End(); endResponse.Error != nil {
+			client.GetLogger().Info("Aperture flow control end got error.", "error", endResponse.Error)
+		}
+	}()
+
+	if !flow.ShouldRun() {
+		return result, flow.RejectionError()
+	}
+
+	useResultCache := params.ResultCacheKey != "" && params.ResultCacheTTL > 0
+	if useResultCache {
+		if lookup := flow.ResultCache(); lookup.Error() == nil && lookup.LookupStatus() == LookupStatusHit {
+			unmarshalErr := json.Unmarshal(lookup.Value(), &result)
+			if unmarshalErr == nil {
+				return result, nil
+			}
+			client.GetLogger().Warn("Aperture result cache entry could not be decoded.", "controlPoint", controlPoint, "error", unmarshalErr)
+		}
+	}
+
+	ran = true
+	result, err = fn(ctx)
+	panicked = false
+	if err != nil || !useResultCache {
+		return result, err
+	}
+
+	value, marshalErr := json.Marshal(result)
+	if marshalErr != nil {
+		client.GetLogger().Warn("Aperture result could not be encoded for the result cache.", "controlPoint", controlPoint, "error", marshalErr)
+		return result, nil
+	}
+	if upsertResponse := flow.SetResultCache(ctx, CacheEntry{Value: value, TTL: params.ResultCacheTTL}, params.CallOptions...); upsertResponse.Error() != nil {
+		client.GetLogger().Warn("Aperture result cache entry could not be stored.", "controlPoint", controlPoint, "error", upsertResponse.Error())
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package aperture_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+func TestRunRejectedFlowEndsWithDefaultStatus(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetFlowOptions("rejected", aperturetest.FlowOptions{Reject: true})
+
+	_, err := aperture.Run(context.Background(), client, "rejected", aperture.RunParams{}, func(context.Context) (int, error) {
+		t.Fatalf("workload ran for a rejected flow")
+		return 0, nil
+	})
+	if !errors.Is(err, aperture.ErrRejected) {
+		t.Fatalf("Run() error = %v, want %v", err, aperture.ErrRejected)
+	}
+
+	flow := client.Flows()[0]
+	flow.AssertEnded(t, aperture.OK)
+	if statuses := flow.Statuses(); len(statuses) != 0 {
+		t.Errorf("statuses set = %v, want none", statuses)
+	}
+}
+
+func TestRunWorkloadErrorEndsWithError(t *testing.T) {
+	client := aperturetest.NewClient()
+	workloadErr := errors.New("boom")
+
+	_, err := aperture.Run(context.Background(), client, "failing", aperture.RunParams{}, func(context.Context) (int, error) {
+		return 0, workloadErr
+	})
+	if !errors.Is(err, workloadErr) {
+		t.Fatalf("Run() error = %v, want %v", err, workloadErr)
+	}
+	client.Flows()[0].AssertEnded(t, aperture.Error)
+}
+
+func TestRunWorkloadPanicEndsWithError(t *testing.T) {
+	client := aperturetest.NewClient()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the workload panic", r)
+			}
+		}()
+		_, _ = aperture.Run(context.Background(), client, "panicking", aperture.RunParams{}, func(context.Context) (int, error) {
+			panic("boom")
+		})
+	}()
+
+	client.Flows()[0].AssertEnded(t, aperture.Error)
+}
+
+func TestRunResultCacheHitSkipsWorkload(t *testing.T) {
+	client := aperturetest.NewClient()
+	client.SetFlowOptions("cached", aperturetest.FlowOptions{ResultCache: []byte("42")})
+	params := aperture.RunParams{
+		FlowParams:     aperture.FlowParams{ResultCacheKey: "answer"},
+		ResultCacheTTL: time.Minute,
+	}
+
+	got, err := aperture.Run(context.Background(), client, "cached", params, func(context.Context) (int, error) {
+		t.Fatalf("workload ran on a result cache hit")
+		return 0, nil
+	})
+	if err != nil || got != 42 {
+		t.Fatalf("Run() = %d, %v, want 42, nil", got, err)
+	}
+	client.Flows()[0].AssertEnded(t, aperture.OK)
+}
@@ -0,0 +1,300 @@
+package aperture_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	checkhttpv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/checkhttp/v1"
+
+	aperture "github.com/fluxninja/aperture-go/v2/sdk"
+	"github.com/fluxninja/aperture-go/v2/sdk/aperturetest"
+)
+
+// newCallerTracerProvider returns a tracer provider standing for the one of the caller, recording the ended spans.
+func newCallerTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	return tp, exporter
+}
+
+// keptSpansExporter is an in-memory exporter keeping its spans once the client shutting down shuts it down.
+type keptSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpansExporter) Shutdown(context.Context) error { return nil }
+
+// spansNamed returns the recorded spans with the given name.
+func spansNamed(exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStubs {
+	var spans tracetest.SpanStubs
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestCallerSpanCoversFlow(t *testing.T) {
+	callerTP, callerExporter := newCallerTracerProvider(t)
+	agentExporter := tracetest.NewInMemoryExporter()
+	client, _ := newAgentClient(t, aperture.Options{SpanExporter: keptSpansExporter{agentExporter}})
+
+	ctx, parent := callerTP.Tracer("test").Start(context.Background(), "request")
+	flow := client.StartFlow(ctx, "traced", aperture.FlowParams{})
+	if got := spansNamed(callerExporter, "Aperture Check"); len(got) != 0 {
+		t.Fatalf("caller spans ended before the flow = %d, want 0", len(got))
+	}
+	flow.End()
+	parent.End()
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	callerSpans := spansNamed(callerExporter, "Aperture Check")
+	if len(callerSpans) != 1 {
+		t.Fatalf("caller spans = %d, want 1", len(callerSpans))
+	}
+	if got, want := callerSpans[0].Parent.SpanID(), parent.SpanContext().SpanID(); got != want {
+		t.Errorf("caller span parent = %s, want %s", got, want)
+	}
+
+	flowSpans := spansNamed(agentExporter, "Aperture Check")
+	if len(flowSpans) != 1 {
+		t.Fatalf("flow spans exported to Aperture Agent = %d, want 1", len(flowSpans))
+	}
+	if got, want := flowSpans[0].Parent.SpanID(), parent.SpanContext().SpanID(); got != want {
+		t.Errorf("flow span parent = %s, want %s", got, want)
+	}
+	if got := len(flowSpans[0].Links); got != 0 {
+		t.Errorf("flow span links = %d, want 0", got)
+	}
+}
+
+func TestContextWithFlowSpan(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		opts       func(tp trace.TracerProvider) aperture.Options
+		callerSpan bool
+	}{
+		{name: "dedicated provider", opts: func(trace.TracerProvider) aperture.Options { return aperture.Options{} }, callerSpan: true},
+		{name: "caller provider", opts: func(tp trace.TracerProvider) aperture.Options { return aperture.Options{TracerProvider: tp} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			callerTP, callerExporter := newCallerTracerProvider(t)
+			client, _ := newAgentClient(t, tc.opts(callerTP))
+			t.Cleanup(func() { _ = client.Shutdown(context.Background()) })
+
+			ctx, parent := callerTP.Tracer("test").Start(context.Background(), "request")
+			defer parent.End()
+			flow := client.StartFlow(ctx, "traced", aperture.FlowParams{})
+			httpFlow := client.StartHTTPFlow(ctx, &checkhttpv1.CheckHTTPRequest{ControlPoint: "traced"}, aperture.MiddlewareParams{})
+
+			for name, flow := range map[string]interface{ Span() trace.Span }{"flow": flow, "HTTP flow": httpFlow} {
+				_, child := callerTP.Tracer("test").Start(aperture.ContextWithFlowSpan(ctx, flow), "downstream")
+				child.End()
+				downstream := spansNamed(callerExporter, "downstream")
+				got := downstream[len(downstream)-1].Parent
+
+				if got.TraceID() != parent.SpanContext().TraceID() {
+					t.Errorf("%s: downstream span trace = %s, want the caller's %s", name, got.TraceID(), parent.SpanContext().TraceID())
+				}
+				if !tc.callerSpan {
+					if got.SpanID() != flow.Span().SpanContext().SpanID() {
+						t.Errorf("%s: downstream span parent = %s, want the flow span %s", name, got.SpanID(), flow.Span().SpanContext().SpanID())
+					}
+					continue
+				}
+				if got.SpanID() == flow.Span().SpanContext().SpanID() || got.SpanID() == parent.SpanContext().SpanID() {
+					t.Errorf("%s: downstream span parent = %s, want the caller-side flow span", name, got.SpanID())
+				}
+			}
+
+			flow.End()
+			httpFlow.End()
+			if !tc.callerSpan {
+				return
+			}
+			callerSpans := spansNamed(callerExporter, "Aperture Check")
+			if len(callerSpans) != 2 {
+				t.Fatalf("caller spans = %d, want 2", len(callerSpans))
+			}
+			for _, downstream := range spansNamed(callerExporter, "downstream") {
+				if id := downstream.Parent.SpanID(); id != callerSpans[0].SpanContext.SpanID() && id != callerSpans[1].SpanContext.SpanID() {
+					t.Errorf("downstream span parent = %s, want one of the caller spans", id)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterGlobalTracerProvider(t *testing.T) {
+	for _, register := range []bool{false, true} {
+		t.Run(fmt.Sprintf("register %t", register), func(t *testing.T) {
+			callerTP, _ := newCallerTracerProvider(t)
+			otel.SetTracerProvider(callerTP)
+			t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+			agentExporter := tracetest.NewInMemoryExporter()
+			client, _ := newAgentClient(t, aperture.Options{
+				SpanExporter:                 keptSpansExporter{agentExporter},
+				RegisterGlobalTracerProvider: register,
+			})
+			if got := otel.GetTracerProvider() == trace.TracerProvider(callerTP); got == register {
+				t.Fatalf("global tracer provider unchanged = %t, want %t", got, !register)
+			}
+
+			_, span := otel.Tracer("test").Start(context.Background(), "global")
+			span.End()
+			if err := client.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown() error = %v", err)
+			}
+			want := 0
+			if register {
+				want = 1
+			}
+			if got := len(spansNamed(agentExporter, "global")); got != want {
+				t.Errorf("spans of the global tracer provider exported to Aperture Agent = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestShutdownKeepsCallerTracerProvider(t *testing.T) {
+	callerTP, callerExporter := newCallerTracerProvider(t)
+	client, _ := newAgentClient(t, aperture.Options{TracerProvider: callerTP})
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	_, span := callerTP.Tracer("test").Start(context.Background(), "after shutdown")
+	span.End()
+	if got := len(spansNamed(callerExporter, "after shutdown")); got != 1 {
+		t.Errorf("spans recorded by the caller's tracer provider after Shutdown = %d, want 1", got)
+	}
+}
+
+// batchRecorder is a span exporter recording the size of the exported batches.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches []int
+}
+
+func (r *batchRecorder) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, len(spans))
+	return nil
+}
+
+func (r *batchRecorder) Shutdown(context.Context) error { return nil }
+
+func (r *batchRecorder) Batches() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.batches...)
+}
+
+func TestSpanExporter(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	client, agent := newAgentClient(t, aperture.Options{SpanExporter: keptSpansExporter{exporter}})
+
+	client.StartFlow(context.Background(), "exported", aperture.FlowParams{}).End()
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if got := len(spansNamed(exporter, "Aperture Check")); got != 1 {
+		t.Errorf("flow spans exported with the SpanExporter = %d, want 1", got)
+	}
+	if got := len(agent.TraceExportRequests()); got != 0 {
+		t.Errorf("trace export requests to Aperture Agent = %d, want 0", got)
+	}
+}
+
+func TestOTLPAddress(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		otlp bool
+	}{
+		{name: "flow control connection"},
+		{name: "OTLP address", otlp: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent := aperturetest.NewAgent()
+			t.Cleanup(agent.Close)
+			otlpAgent := aperturetest.NewAgent()
+			t.Cleanup(otlpAgent.Close)
+
+			opts := aperture.Options{Address: "agent", DialOptions: agent.DialOptions()}
+			if tc.otlp {
+				opts.OTLPAddress = "otlp"
+				opts.OTLPDialOptions = otlpAgent.DialOptions()
+			}
+			client, err := aperture.NewClient(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			client.StartFlow(context.Background(), "exported", aperture.FlowParams{}).End()
+			if err := client.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown() error = %v", err)
+			}
+
+			if got := len(agent.TraceExportRequests()) > 0; got != !tc.otlp {
+				t.Errorf("flow spans exported over the flow control connection = %t, want %t", got, !tc.otlp)
+			}
+			if got := len(otlpAgent.TraceExportRequests()) > 0; got != tc.otlp {
+				t.Errorf("flow spans exported to the OTLP address = %t, want %t", got, tc.otlp)
+			}
+		})
+	}
+}
+
+func TestSpanBatchOptions(t *testing.T) {
+	t.Run("max export batch size", func(t *testing.T) {
+		exporter := &batchRecorder{}
+		client, _ := newAgentClient(t, aperture.Options{
+			SpanExporter:     exporter,
+			SpanBatchOptions: aperture.SpanBatchOptions{MaxExportBatchSize: 1},
+		})
+		for i := 0; i < 3; i++ {
+			client.StartFlow(context.Background(), "batched", aperture.FlowParams{}).End()
+		}
+		if err := client.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown() error = %v", err)
+		}
+		if got := exporter.Batches(); !reflect.DeepEqual(got, []int{1, 1, 1}) {
+			t.Errorf("exported batches = %v, want [1 1 1]", got)
+		}
+	})
+
+	t.Run("batch timeout", func(t *testing.T) {
+		exporter := &batchRecorder{}
+		client, _ := newAgentClient(t, aperture.Options{
+			SpanExporter:     exporter,
+			SpanBatchOptions: aperture.SpanBatchOptions{BatchTimeout: 10 * time.Millisecond},
+		})
+		t.Cleanup(func() { _ = client.Shutdown(context.Background()) })
+
+		start := time.Now()
+		client.StartFlow(context.Background(), "batched", aperture.FlowParams{}).End()
+		for len(exporter.Batches()) == 0 {
+			if time.Since(start) > time.Second {
+				t.Fatalf("flow span not exported within 1s, want it exported after the batch timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package aperture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	// ErrCacheEntryInvalid is returned by TypedCache when a cache entry was not written by a TypedCache.
+	ErrCacheEntryInvalid = errors.New("cache entry was not written by a typed cache")
+	// ErrCacheEntryVersionMismatch is returned by TypedCache when a cache entry was written with another TypedCacheOptions.Version.
+	ErrCacheEntryVersionMismatch = errors.New("cache entry version mismatch")
+)
+
+// Typed cache entries are laid out as: magic byte, flags byte, big-endian uint32 version, encoded value.
+const (
+	typedCacheEntryMagic      byte = 0xAC
+	typedCacheEntryCompressed byte = 1 << 0
+	typedCacheEntryHeaderSize      = 6
+)
+
+// TypedCacheOptions configure a TypedCache.
+type TypedCacheOptions struct {
+	// Codec encodes and decodes the values. Defaults to JSONCodec.
+	Codec Codec
+	// Version is the schema version stamped on the written entries. Entries of other versions are treated as misses,
+	// so changing the type of the values only requires bumping the version.
+	Version uint32
+	// CompressionThreshold is the size from which encoded values are gzip compressed. Zero disables the compression.
+	CompressionThreshold int
+}
+
+// TypedCache reads and writes values of type T in the result and global caches, encoded by a Codec.
+// Lookups report a miss, along with the reason, for entries which cannot be decoded, e.g. because they were written
+// with another version, so the callers can simply recompute and overwrite them.
+type TypedCache[T any] struct {
+	opts TypedCacheOptions
+}
+
+// NewTypedCache creates a new TypedCache.
+func NewTypedCache[T any](opts TypedCacheOptions) *TypedCache[T] {
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec{}
+	}
+	return &TypedCache[T]{opts: opts}
+}
+
+// Encode encodes value into a cache entry value.
+func (tc *TypedCache[T]) Encode(value T) ([]byte, error) {
+	payload, err := tc.opts.Codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if tc.opts.CompressionThreshold > 0 && len(payload) >= tc.opts.CompressionThreshold {
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		if _, err = gzipWriter.Write(payload); err != nil {
+			return nil, err
+		}
+		if err = gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+		flags |= typedCacheEntryCompressed
+	}
+
+	data := make([]byte, typedCacheEntryHeaderSize, typedCacheEntryHeaderSize+len(payload))
+	data[0] = typedCacheEntryMagic
+	data[1] = flags
+	binary.BigEndian.PutUint32(data[2:typedCacheEntryHeaderSize], tc.opts.Version)
+	return append(data, payload...), nil
+}
+
+// Decode decodes a cache entry value written by Encode. A panic of the Codec is returned as an error.
+func (tc *TypedCache[T]) Decode(data []byte) (value T, err error) {
+	if len(data) < typedCacheEntryHeaderSize || data[0] != typedCacheEntryMagic {
+		return value, ErrCacheEntryInvalid
+	}
+	if version := binary.BigEndian.Uint32(data[2:typedCacheEntryHeaderSize]); version != tc.opts.Version {
+		return value, fmt.Errorf("%w: got %d, want %d", ErrCacheEntryVersionMismatch, version, tc.opts.Version)
+	}
+
+	payload := data[typedCacheEntryHeaderSize:]
+	if data[1]&typedCacheEntryCompressed != 0 {
+		gzipReader, gzipErr := gzip.NewReader(bytes.NewReader(payload))
+		if gzipErr != nil {
+			return value, gzipErr
+		}
+		if payload, err = io.ReadAll(gzipReader); err != nil {
+			return value, err
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			var zero T
+			value, err = zero, fmt.Errorf("cache entry decoding panicked: %v", r)
+		}
+	}()
+	err = tc.opts.Codec.Unmarshal(payload, &value)
+	return value, err
+}
+
+// ResultCache returns the decoded result cache entry of flow. The bool reports whether it is a usable hit.
+func (tc *TypedCache[T]) ResultCache(flow Flow) (T, bool, error) {
+	return tc.decodeLookup(flow.ResultCache())
+}
+
+// SetResultCache encodes value and sets it as the result cache entry of flow.
+func (tc *TypedCache[T]) SetResultCache(ctx context.Context, flow Flow, value T, ttl time.Duration, opts ...grpc.CallOption) error {
+	data, err := tc.Encode(value)
+	if err != nil {
+		return err
+	}
+	return flow.SetResultCache(ctx, CacheEntry{Value: data, TTL: ttl}, opts...).Error()
+}
+
+// GlobalCache returns the decoded global cache entry of flow at key. The bool reports whether it is a usable hit.
+func (tc *TypedCache[T]) GlobalCache(flow Flow, key string) (T, bool, error) {
+	return tc.decodeLookup(flow.GlobalCache(key))
+}
+
+// SetGlobalCache encodes value and sets it as the global cache entry of flow at key.
+func (tc *TypedCache[T]) SetGlobalCache(ctx context.Context, flow Flow, key string, value T, ttl time.Duration, opts ...grpc.CallOption) error {
+	data, err := tc.Encode(value)
+	if err != nil {
+		return err
+	}
+	return flow.SetGlobalCache(ctx, key, CacheEntry{Value: data, TTL: ttl}, opts...).Error()
+}
+
+// Get returns the decoded entry of globalCache at key. The bool reports whether it is a usable hit.
+func (tc *TypedCache[T]) Get(ctx context.Context, globalCache GlobalCache, key string, opts ...grpc.CallOption) (T, bool, error) {
+	return tc.decodeLookup(globalCache.Get(ctx, []string{key}, opts...)[key])
+}
+
+// Set encodes value and sets it as the entry of globalCache at key.
+func (tc *TypedCache[T]) Set(ctx context.Context, globalCache GlobalCache, key string, value T, ttl time.Duration, opts ...grpc.CallOption) error {
+	data, err := tc.Encode(value)
+	if err != nil {
+		return err
+	}
+	return globalCache.Set(ctx, map[string]CacheEntry{key: {Value: data, TTL: ttl}}, opts...)[key].Error()
+}
+
+// decodeLookup decodes the value of a cache hit.
+func (tc *TypedCache[T]) decodeLookup(lookup KeyLookupResponse) (value T, hit bool, err error) {
+	if lookup == nil {
+		return value, false, ErrKeyMissingFromGlobalCacheResponse
+	}
+	if lookup.Error() != nil {
+		return value, false, lookup.Error()
+	}
+	if lookup.LookupStatus() != LookupStatusHit {
+		return value, false, nil
+	}
+	value, err = tc.Decode(lookup.Value())
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	checkv1 "github.com/fluxninja/aperture/api/v2/gen/proto/go/aperture/flowcontrol/check/v1"
+)
+
+type typedCacheValue struct {
+	Name  string
+	Count int
+}
+
+func TestTypedCacheRoundTrip(t *testing.T) {
+	want := typedCacheValue{Name: "name", Count: 42}
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			tc := NewTypedCache[typedCacheValue](TypedCacheOptions{Codec: codec})
+			data, err := tc.Encode(want)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			got, err := tc.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got != want {
+				t.Errorf("Decode() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTypedCacheProtoCodec(t *testing.T) {
+	tc := NewTypedCache[*checkv1.CacheEntry](TypedCacheOptions{Codec: ProtoCodec{}})
+	want := &checkv1.CacheEntry{Key: "key", Value: []byte("value"), Ttl: durationpb.New(time.Minute)}
+
+	data, err := tc.Encode(want)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	got, err := tc.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Decode() = %v, want %v", got, want)
+	}
+}
+
+func TestTypedCacheCompression(t *testing.T) {
+	tc := NewTypedCache[string](TypedCacheOptions{CompressionThreshold: 64})
+	want := string(bytes.Repeat([]byte("a"), 1024))
+
+	data, err := tc.Encode(want)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if len(data) >= len(want) {
+		t.Errorf("encoded size = %d, want it compressed below %d", len(data), len(want))
+	}
+	got, err := tc.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("Decode() returned %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestTypedCacheVersionMismatch(t *testing.T) {
+	oldCache := NewTypedCache[string](TypedCacheOptions{Version: 1})
+	newCache := NewTypedCache[typedCacheValue](TypedCacheOptions{Version: 2})
+
+	data, err := oldCache.Encode("old")
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if _, err = newCache.Decode(data); !errors.Is(err, ErrCacheEntryVersionMismatch) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrCacheEntryVersionMismatch)
+	}
+
+	value, hit, err := newCache.decodeLookup(newKeyLookupResponse(data, LookupStatusHit, nil))
+	if hit || !errors.Is(err, ErrCacheEntryVersionMismatch) || value != (typedCacheValue{}) {
+		t.Errorf("decodeLookup() = %+v, %t, %v, want a miss", value, hit, err)
+	}
+}
+
+func TestTypedCacheInvalidEntry(t *testing.T) {
+	tc := NewTypedCache[string](TypedCacheOptions{})
+
+	if _, err := tc.Decode([]byte(`"raw"`)); !errors.Is(err, ErrCacheEntryInvalid) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrCacheEntryInvalid)
+	}
+}